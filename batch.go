@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/wire"
+	conf "github.com/bytefly/dashcash-wallet/config"
+	"github.com/bytefly/dashcash-wallet/util"
+	"log"
+	"math/big"
+	"strings"
+	"time"
+
+	badger "github.com/dgraph-io/badger"
+)
+
+const (
+	BATCH_KEY_PREFIX = "batch/"
+	// sending/<hash> holds a signed batch tx until its broadcast is settled
+	SENDING_KEY_PREFIX = "sending/"
+)
+
+const (
+	// the node never got the tx, all its inputs are unspent
+	TX_UNSENT = iota
+	// the tx is in the mempool or has unspent outputs
+	TX_SENT
+	// the node cannot tell, it is unreachable or the inputs are spent
+	TX_UNKNOWN
+)
+
+// errSendUnresolved is returned when the broadcast of a batch tx failed but
+// the node may have taken it. Its requests stay sending until it is settled.
+var errSendUnresolved = errors.New("batch tx broadcast unresolved")
+
+// Sending is a signed batch tx recorded before its broadcast.
+type Sending struct {
+	Raw     string
+	FeeRate uint32
+	Created int64
+}
+
+// BatchOutput maps an output of a batch withdrawal to the withdrawal request
+// it pays.
+type BatchOutput struct {
+	RequestId string
+	Address   string
+	Amount    int64
+	Index     uint32
+	// share of the tx fee charged to the request
+	Fee int64
+	// id of the queued withdrawal, 0 when sent directly
+	Withdrawal uint64
+}
+
+func batchKey(txHash string) []byte {
+	return []byte(BATCH_KEY_PREFIX + txHash)
+}
+
+func sendingKey(txHash string) []byte {
+	return []byte(SENDING_KEY_PREFIX + txHash)
+}
+
+func putBatch(txn *badger.Txn, txHash string, outputs []BatchOutput) error {
+	buf, err := json.Marshal(outputs)
+	if err != nil {
+		return err
+	}
+	return txn.Set(batchKey(txHash), buf)
+}
+
+func saveBatch(txHash string, outputs []BatchOutput) error {
+	return db.Update(func(txn *badger.Txn) error {
+		return putBatch(txn, txHash, outputs)
+	})
+}
+
+func readBatch(txn *badger.Txn, txHash string) ([]BatchOutput, error) {
+	item, err := txn.Get(batchKey(txHash))
+	if err != nil {
+		return nil, err
+	}
+	var outputs []BatchOutput
+	err = item.Value(func(v []byte) error {
+		return json.Unmarshal(v, &outputs)
+	})
+	return outputs, err
+}
+
+func getBatch(txHash string) ([]BatchOutput, error) {
+	var outputs []BatchOutput
+	err := db.View(func(txn *badger.Txn) error {
+		var err error
+		outputs, err = readBatch(txn, txHash)
+		return err
+	})
+	return outputs, err
+}
+
+func deleteBatch(txHash string) error {
+	return db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(batchKey(txHash))
+	})
+}
+
+// splitBatchFee charges the fee evenly to the outputs, the remainder to the
+// first one.
+func splitBatchFee(outputs []BatchOutput, fee int64) {
+	if len(outputs) == 0 {
+		return
+	}
+	share := fee / int64(len(outputs))
+	for i := range outputs {
+		outputs[i].Fee = share
+	}
+	outputs[0].Fee += fee - share*int64(len(outputs))
+}
+
+// attributeBatch tags the withdraw message with its output index, and with
+// the request it pays and its share of the fee when the tx is a batch
+// withdrawal.
+func attributeBatch(batch []BatchOutput, message NotifyMessage, index uint32) NotifyMessage {
+	message.OutputIndex = index
+	for _, o := range batch {
+		if o.Index == index {
+			message.RequestId = o.RequestId
+			message.Fee = big.NewInt(o.Fee)
+			break
+		}
+	}
+	return message
+}
+
+// recordSending stores the batch and the signed tx, and moves its queued
+// withdrawals to sending, all before the broadcast, so a request is never
+// picked again once its tx may have reached the node.
+func recordSending(hash string, batch []BatchOutput, sending *Sending) error {
+	buf, err := json.Marshal(sending)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(txn *badger.Txn) error {
+		if err := putBatch(txn, hash, batch); err != nil {
+			return err
+		}
+		if err := txn.Set(sendingKey(hash), buf); err != nil {
+			return err
+		}
+		for _, o := range batch {
+			if o.Withdrawal == 0 {
+				continue
+			}
+			w, err := readWithdrawal(txn, o.Withdrawal)
+			if err != nil {
+				return err
+			}
+			if w.State != WITHDRAWAL_QUEUED {
+				return fmt.Errorf("withdrawal %d is no longer queued", w.Id)
+			}
+			w.State = WITHDRAWAL_SENDING
+			w.TxHash = hash
+			w.Fee = o.Fee
+			if err = putWithdrawal(txn, w); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// finishSending settles a batch tx: its withdrawals become broadcast when
+// the node took it, or go back to the queue with the batch dropped when it
+// never reached the node.
+func finishSending(hash string, sent bool) error {
+	return db.Update(func(txn *badger.Txn) error {
+		batch, err := readBatch(txn, hash)
+		if err != nil && err != badger.ErrKeyNotFound {
+			return err
+		}
+		for _, o := range batch {
+			if o.Withdrawal == 0 {
+				continue
+			}
+			w, err := readWithdrawal(txn, o.Withdrawal)
+			if err != nil {
+				return err
+			}
+			if w.State != WITHDRAWAL_SENDING || w.TxHash != hash {
+				continue
+			}
+			if sent {
+				w.State = WITHDRAWAL_BROADCAST
+				w.Error = ""
+			} else {
+				w.State = WITHDRAWAL_QUEUED
+				w.TxHash = ""
+				w.Fee = 0
+			}
+			if err = putWithdrawal(txn, w); err != nil {
+				return err
+			}
+		}
+		if !sent {
+			if err = txn.Delete(batchKey(hash)); err != nil {
+				return err
+			}
+		}
+		return txn.Delete(sendingKey(hash))
+	})
+}
+
+// txOnNode tells whether the node has the tx, looking for it in the mempool
+// and for its outputs in the utxo set. A tx not found is only known unsent
+// when all its inputs are unspent.
+func txOnNode(client *rpcclient.Client, tx *wire.MsgTx) (int, error) {
+	hash := tx.TxHash()
+	if _, err := client.GetMempoolEntry(hash.String()); err == nil {
+		return TX_SENT, nil
+	}
+	for i := range tx.TxOut {
+		out, err := client.GetTxOut(&hash, uint32(i), true)
+		if err != nil {
+			return TX_UNKNOWN, err
+		}
+		if out != nil {
+			return TX_SENT, nil
+		}
+	}
+	for _, in := range tx.TxIn {
+		out, err := client.GetTxOut(&in.PreviousOutPoint.Hash, in.PreviousOutPoint.Index, true)
+		if err != nil {
+			return TX_UNKNOWN, err
+		}
+		if out == nil {
+			return TX_UNKNOWN, nil
+		}
+	}
+	return TX_UNSENT, nil
+}
+
+// resolveSending settles the batch tx recorded before its broadcast by
+// asking the node whether it has it. The caller holds m.
+func resolveSending(config *conf.Config, hash string, sending *Sending) (int, error) {
+	tx, err := decodeRawTx(sending.Raw)
+	if err != nil {
+		return TX_UNKNOWN, err
+	}
+	// recorded by broadcastTx, so the node took it
+	if _, err = getSentTx(hash); err == nil {
+		return TX_SENT, finishSending(hash, true)
+	}
+
+	client, err := ConnectRPC(config)
+	if err != nil {
+		return TX_UNKNOWN, err
+	}
+	state, err := txOnNode(client, tx)
+	client.Shutdown()
+	if err != nil {
+		return TX_UNKNOWN, err
+	}
+	if state == TX_UNKNOWN {
+		// a mined tx with its outputs spent is only known from our blocks
+		height, conflict, err := minedTx(tx)
+		if err != nil {
+			return TX_UNKNOWN, err
+		}
+		if height > 0 {
+			state = TX_SENT
+		} else if conflict != "" {
+			log.Println("batch tx", hash, "conflicts with", conflict)
+			state = TX_UNSENT
+		}
+	}
+
+	switch state {
+	case TX_SENT:
+		log.Println("batch tx", hash, "reached the node")
+		inputs, err := inputUtxos(tx)
+		if err != nil {
+			log.Println("get tx inputs err:", err)
+		}
+		recordSentTx(config, tx, inputs, sending.FeeRate)
+		err = finishSending(hash, true)
+		return state, err
+	case TX_UNSENT:
+		log.Println("batch tx", hash, "never reached the node, requeue its requests")
+		return state, finishSending(hash, false)
+	}
+	return state, nil
+}
+
+// resolveSendingTxs settles the batch txs left sending by a failed or
+// interrupted broadcast. The caller holds m.
+func resolveSendingTxs(config *conf.Config) {
+	pending := make(map[string]*Sending)
+	err := db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(SENDING_KEY_PREFIX)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			s := new(Sending)
+			err := it.Item().Value(func(v []byte) error {
+				return json.Unmarshal(v, s)
+			})
+			if err != nil {
+				return err
+			}
+			pending[string(it.Item().Key()[len(SENDING_KEY_PREFIX):])] = s
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("list sending txs err:", err)
+		return
+	}
+
+	for hash, s := range pending {
+		state, err := resolveSending(config, hash, s)
+		if err != nil {
+			log.Println("resolve batch tx err:", err, hash)
+		} else if state == TX_UNKNOWN {
+			log.Println("batch tx", hash, "is still unresolved")
+		}
+	}
+}
+
+// sendBatch builds, signs and broadcasts one tx paying all the outputs of the
+// batch from the inner utxos, and fills in their fee share. The caller holds m.
+func sendBatch(config *conf.Config, batch []BatchOutput, feeRate uint32, selector CoinSelector) (string, int64, error) {
+	param := util.GetParamByName(config.ChainName)
+	outputs := make([]TxOut, len(batch))
+	for i, o := range batch {
+		to := o.Address
+		if strings.HasPrefix(strings.ToLower(config.ChainName), "bch") {
+			to, _ = util.ConvertCashAddrToLegacy(to, param)
+		}
+		outputs[o.Index] = TxOut{Address: to, Amount: o.Amount}
+		batch[i].Fee = 0
+	}
+
+	tx, _ := CreateTxForOutputs(feeRate, "", outputs, "", param, true, false, selector)
+	if tx == nil {
+		return "", 0, errors.New("utxo out of balance")
+	}
+	if rbfEnabled(config) {
+		signalRBF(tx)
+	}
+	fee := txFeePaid(tx)
+	splitBatchFee(batch, fee)
+
+	signedTx, err := SignMsgTx(config.ChainName, config.Xpriv, tx)
+	if err != nil {
+		return "", 0, errors.New("tx cannot be signed")
+	}
+	hash := signedTx.TxHash().String()
+
+	// record the requests before the tx can show up in a block
+	var buf bytes.Buffer
+	signedTx.Serialize(&buf)
+	sending := &Sending{Raw: hex.EncodeToString(buf.Bytes()), FeeRate: feeRate, Created: time.Now().Unix()}
+	if err = recordSending(hash, batch, sending); err != nil {
+		log.Println("save batch err:", err)
+		return "", 0, errors.New("save batch err")
+	}
+	if _, err = broadcastTx(config, signedTx, feeRate); err != nil {
+		log.Println("send tx err:", err)
+		// the node may have taken the tx before the call failed
+		state, rerr := resolveSending(config, hash, sending)
+		if rerr != nil {
+			log.Println("resolve batch tx err:", rerr, hash)
+		}
+		switch state {
+		case TX_UNSENT:
+			return "", 0, fmt.Errorf("send tx err:%v", err)
+		case TX_UNKNOWN:
+			return hash, fee, errSendUnresolved
+		}
+	} else if err = finishSending(hash, true); err != nil {
+		log.Println("settle batch tx err:", err, hash)
+	}
+	log.Println("new generated batch tx:", hash, "outputs:", len(batch), "fee:", fee, "fee rate:", feeRate)
+	return hash, fee, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestSplitBatchFee(t *testing.T) {
+	cases := []struct {
+		name    string
+		outputs int
+		fee     int64
+		shares  []int64
+	}{
+		{"no outputs", 0, 1000, []int64{}},
+		{"single output", 1, 1234, []int64{1234}},
+		{"even split", 4, 1000, []int64{250, 250, 250, 250}},
+		{"remainder to the first", 3, 1000, []int64{334, 333, 333}},
+		{"fee below the outputs", 3, 2, []int64{2, 0, 0}},
+		{"zero fee", 2, 0, []int64{0, 0}},
+	}
+
+	for _, c := range cases {
+		batch := make([]BatchOutput, c.outputs)
+		for i := range batch {
+			// stale shares of an earlier attempt are overwritten
+			batch[i].Fee = 99
+		}
+		splitBatchFee(batch, c.fee)
+
+		var total int64
+		for i, o := range batch {
+			if o.Fee != c.shares[i] {
+				t.Fatalf("%s: share %d is %d, want %d", c.name, i, o.Fee, c.shares[i])
+			}
+			total += o.Fee
+		}
+		if c.outputs > 0 && total != c.fee {
+			t.Fatalf("%s: shares add up to %d, want %d", c.name, total, c.fee)
+		}
+	}
+}
+
+func TestAttributeBatch(t *testing.T) {
+	batch := []BatchOutput{
+		{RequestId: "r1", Index: 0, Fee: 334},
+		{RequestId: "r2", Index: 1, Fee: 333},
+	}
+	cases := []struct {
+		name      string
+		batch     []BatchOutput
+		index     uint32
+		requestId string
+		fee       int64
+	}{
+		{"first output", batch, 0, "r1", 334},
+		{"second output", batch, 1, "r2", 333},
+		{"change output", batch, 2, "", 500},
+		{"not a batch", nil, 1, "", 500},
+	}
+
+	for _, c := range cases {
+		message := NotifyMessage{TxHash: "tx", Fee: big.NewInt(500)}
+		message = attributeBatch(c.batch, message, c.index)
+		if message.RequestId != c.requestId || message.Fee.Int64() != c.fee || message.OutputIndex != c.index {
+			t.Fatalf("%s: got request %q fee %d index %d", c.name, message.RequestId, message.Fee.Int64(), message.OutputIndex)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	conf "github.com/bytefly/dashcash-wallet/config"
+	"log"
+	"time"
+)
+
+// benchmarkCatchUp runs the catch-up pipeline over count blocks from the
+// height, fetching the blocks and resolving the prevouts of the txs touching
+// the wallet, without changing it, and logs the throughput.
+func benchmarkCatchUp(config *conf.Config, from, count int64) error {
+	client, err := ConnectRPC(config)
+	if err != nil {
+		return err
+	}
+	defer client.Shutdown()
+
+	quit := make(chan struct{})
+	defer close(quit)
+
+	var (
+		stats   PrevoutStats
+		blocks  int
+		txs     int
+		skipped int
+	)
+	start := time.Now()
+	for b := range fetchBlocks(client, from, from+count-1, config.FetchWorkers, quit) {
+		if b.Err != nil {
+			return b.Err
+		}
+		prevouts := newPrevoutCache(client, b.Block, b.Prevouts)
+		for i, tx := range b.Block.Transactions {
+			//ignore coin base
+			if i == 0 {
+				continue
+			}
+			txs++
+			if !touchesWallet(tx, config.ChainName) {
+				skipped++
+				continue
+			}
+			for _, in := range tx.TxIn {
+				if _, err = prevouts.lookup(&in.PreviousOutPoint.Hash, in.PreviousOutPoint.Index); err != nil {
+					log.Println("get transaction err:", err, in.PreviousOutPoint.Hash)
+				}
+			}
+		}
+		stats.add(&prevouts.Stats)
+		blocks++
+	}
+
+	elapsed := time.Since(start)
+	seconds := elapsed.Seconds()
+	log.Printf("bench: %d blocks, %d txs, %d inputs in %v with %d workers", blocks, txs, stats.Inputs, elapsed, config.FetchWorkers)
+	log.Printf("bench: %d txs not touching the wallet skipped, %.1f rpc calls per block", skipped, float64(stats.RPCCalls)/float64(blocks))
+	log.Printf("bench: %.2f blocks/s, %.1f txs/s, %.1f inputs/s", float64(blocks)/seconds, float64(txs)/seconds, float64(stats.Inputs)/seconds)
+	log.Println("bench: prevouts from the block:", stats.BlockHits, "utxo db:", stats.StoreHits,
+		"fetched:", stats.FetchedHits, "rpc calls:", stats.RPCCalls,
+		"verbosity 3:", prevoutVerbosity == VERBOSITY_SUPPORTED)
+	return nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/wire"
+	"log"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	VERBOSITY_UNKNOWN = iota
+	VERBOSITY_SUPPORTED
+	VERBOSITY_UNSUPPORTED
+)
+
+// whether the node gives the prevouts with getblock verbosity 3
+var prevoutVerbosity int32 = VERBOSITY_UNKNOWN
+
+type fetchedBlock struct {
+	Height int64
+	Block  *wire.MsgBlock
+	// prevouts of the inputs, nil when the node does not give them
+	Prevouts map[string]Prevout
+	Err      error
+}
+
+type verboseBlock struct {
+	Hash       string `json:"hash"`
+	Version    int32  `json:"version"`
+	PrevBlock  string `json:"previousblockhash"`
+	MerkleRoot string `json:"merkleroot"`
+	Time       int64  `json:"time"`
+	Bits       string `json:"bits"`
+	Nonce      uint32 `json:"nonce"`
+	Tx         []struct {
+		Hex string `json:"hex"`
+		Vin []struct {
+			Prevout *struct {
+				Value        float64 `json:"value"`
+				ScriptPubKey struct {
+					Hex string `json:"hex"`
+				} `json:"scriptPubKey"`
+			} `json:"prevout"`
+		} `json:"vin"`
+	} `json:"tx"`
+}
+
+var errNoPrevouts = errors.New("no prevouts in the verbose block")
+
+// getBlockWithPrevouts reads the block with getblock verbosity 3, which
+// bitcoind 25 and later answer with the outputs spent by every input.
+func getBlockWithPrevouts(client *rpcclient.Client, hash *chainhash.Hash) (*wire.MsgBlock, map[string]Prevout, error) {
+	params := make([]json.RawMessage, 2)
+	params[0], _ = json.Marshal(hash.String())
+	params[1], _ = json.Marshal(3)
+	raw, err := client.RawRequest("getblock", params)
+	if err != nil {
+		return nil, nil, err
+	}
+	var vb verboseBlock
+	if err = json.Unmarshal(raw, &vb); err != nil {
+		return nil, nil, err
+	}
+
+	block := new(wire.MsgBlock)
+	block.Header.Version = vb.Version
+	if vb.PrevBlock != "" {
+		prev, err := chainhash.NewHashFromStr(vb.PrevBlock)
+		if err != nil {
+			return nil, nil, err
+		}
+		block.Header.PrevBlock = *prev
+	}
+	root, err := chainhash.NewHashFromStr(vb.MerkleRoot)
+	if err != nil {
+		return nil, nil, err
+	}
+	block.Header.MerkleRoot = *root
+	block.Header.Timestamp = time.Unix(vb.Time, 0)
+	bits, err := strconv.ParseUint(vb.Bits, 16, 32)
+	if err != nil {
+		return nil, nil, err
+	}
+	block.Header.Bits = uint32(bits)
+	block.Header.Nonce = vb.Nonce
+
+	prevouts := make(map[string]Prevout)
+	inputs := 0
+	for _, t := range vb.Tx {
+		buf, err := hex.DecodeString(t.Hex)
+		if err != nil {
+			return nil, nil, err
+		}
+		tx := new(wire.MsgTx)
+		if err = tx.Deserialize(bytes.NewReader(buf)); err != nil {
+			return nil, nil, err
+		}
+		block.Transactions = append(block.Transactions, tx)
+
+		for i, in := range t.Vin {
+			if in.Prevout == nil || i >= len(tx.TxIn) {
+				continue
+			}
+			script, err := hex.DecodeString(in.Prevout.ScriptPubKey.Hex)
+			if err != nil {
+				return nil, nil, err
+			}
+			point := tx.TxIn[i].PreviousOutPoint
+			prevouts[outpointKey(point.Hash.String(), point.Index)] = Prevout{Value: toSatoshi(in.Prevout.Value), Script: script}
+		}
+		if len(block.Transactions) > 1 {
+			inputs += len(tx.TxIn)
+		}
+	}
+	if block.BlockHash() != *hash {
+		return nil, nil, fmt.Errorf("verbose block %s does not match its hash", hash)
+	}
+	// older nodes take verbosity 3 for 2 and give no prevouts
+	if inputs > 0 && len(prevouts) == 0 {
+		return nil, nil, errNoPrevouts
+	}
+	return block, prevouts, nil
+}
+
+func fetchBlock(client *rpcclient.Client, height int64) fetchedBlock {
+	b := fetchedBlock{Height: height}
+	hash, err := client.GetBlockHash(height)
+	if err != nil {
+		b.Err = fmt.Errorf("read block hash err: %v", err)
+		return b
+	}
+
+	if atomic.LoadInt32(&prevoutVerbosity) != VERBOSITY_UNSUPPORTED {
+		b.Block, b.Prevouts, err = getBlockWithPrevouts(client, hash)
+		if err == nil {
+			atomic.StoreInt32(&prevoutVerbosity, VERBOSITY_SUPPORTED)
+			return b
+		}
+		if atomic.CompareAndSwapInt32(&prevoutVerbosity, VERBOSITY_UNKNOWN, VERBOSITY_UNSUPPORTED) {
+			log.Println("node gives no prevouts with the blocks:", err)
+		}
+	}
+
+	b.Prevouts = nil
+	if b.Block, err = client.GetBlock(hash); err != nil {
+		b.Err = fmt.Errorf("get block err: %v", err)
+	}
+	return b
+}
+
+// fetchBlocks reads the blocks from..to with up to workers requests at once
+// and delivers them in height order. Closing quit stops the fetching.
+func fetchBlocks(client *rpcclient.Client, from, to int64, workers int, quit <-chan struct{}) <-chan fetchedBlock {
+	if workers < 1 {
+		workers = 1
+	}
+
+	// the results in height order, its size bounds the requests in flight
+	pending := make(chan chan fetchedBlock, workers)
+	go func() {
+		defer close(pending)
+		for height := from; height <= to; height++ {
+			c := make(chan fetchedBlock, 1)
+			select {
+			case pending <- c:
+			case <-quit:
+				return
+			}
+			go func(height int64) {
+				c <- fetchBlock(client, height)
+			}(height)
+		}
+	}()
+
+	out := make(chan fetchedBlock)
+	go func() {
+		defer close(out)
+		for c := range pending {
+			select {
+			case out <- <-c:
+			case <-quit:
+				return
+			}
+		}
+	}()
+	return out
+}
@@ -14,6 +14,8 @@ import (
 	"log"
 	"math/big"
 	"strings"
+
+	badger "github.com/dgraph-io/badger"
 )
 
 func ConnectRPC(config *conf.Config) (*rpcclient.Client, error) {
@@ -57,7 +59,59 @@ func GetOmniTxStatus(c *conf.Config, hash string) (bool, error) {
 	return txResult.Valid, nil
 }
 
-func ParseTransaction(client *rpcclient.Client, msgtx *wire.MsgTx, chainName string, blockTime uint64) (messages []NotifyMessage, err error) {
+// scriptAddress returns the address paid by the script in the form the
+// wallet keeps it.
+func scriptAddress(chainName string, script []byte) (string, bool) {
+	param := util.GetParamByName(chainName)
+	_, addrSet, _, err := txscript.ExtractPkScriptAddrs(script, param)
+	if err != nil || len(addrSet) == 0 {
+		return "", false
+	}
+
+	addrStr := addrSet[0].EncodeAddress()
+	if strings.HasPrefix(strings.ToLower(chainName), "bch") {
+		addrStr, _ = util.ConvertLegacyToCashAddr(addrStr, param)
+		addrStr = addrStr[len(param.Bech32HRPSegwit)+1:]
+	}
+	return addrStr, true
+}
+
+// walletAddress returns our address paid by the script.
+func walletAddress(chainName string, script []byte) (string, bool) {
+	addrStr, ok := scriptAddress(chainName, script)
+	if !ok {
+		return "", false
+	}
+	_, ok = util.LoadAddrPath(addrStr)
+	return addrStr, ok
+}
+
+// touchesWallet tells whether the tx spends one of our outpoints or pays one
+// of our addresses, without asking the node.
+func touchesWallet(msgtx *wire.MsgTx, chainName string) bool {
+	found := false
+	db.View(func(txn *badger.Txn) error {
+		for _, in := range msgtx.TxIn {
+			if isOwnOutpoint(txn, in.PreviousOutPoint.Hash.String(), in.PreviousOutPoint.Index) {
+				found = true
+				return nil
+			}
+		}
+		return nil
+	})
+	if found {
+		return true
+	}
+
+	for _, out := range msgtx.TxOut {
+		if _, ok := walletAddress(chainName, out.PkScript); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func ParseTransaction(prevouts *PrevoutCache, msgtx *wire.MsgTx, chainName string, blockTime uint64, undo *BlockUndo) (messages []NotifyMessage, err error) {
 	var (
 		fee              uint64
 		opReturnNum      int
@@ -73,6 +127,11 @@ func ParseTransaction(client *rpcclient.Client, msgtx *wire.MsgTx, chainName str
 		return messages, fmt.Errorf("Transaction is nil: Can't parse.")
 	}
 
+	// foreign txs need no prevout lookups
+	if !touchesWallet(msgtx, chainName) {
+		return messages, nil
+	}
+
 	hash := msgtx.TxHash().String()
 	extInputAddrNum := 0
 	inputAddrs := make([]string, 0)
@@ -80,6 +139,7 @@ func ParseTransaction(client *rpcclient.Client, msgtx *wire.MsgTx, chainName str
 	outputAddrs := make([]string, 0)
 	outputAddrs2 := make([]string, 0)
 	outputValue := make(map[string]int64)
+	outputIndex := make(map[string]uint32)
 
 	for i := 0; i < len(msgtx.TxIn); i++ {
 		prevHash := msgtx.TxIn[i].PreviousOutPoint.Hash
@@ -88,15 +148,15 @@ func ParseTransaction(client *rpcclient.Client, msgtx *wire.MsgTx, chainName str
 		if prevIndex == 0xFFFFFFFF {
 			continue
 		}
-		tx, err := client.GetRawTransaction(&prevHash)
+		prev, err := prevouts.lookup(&prevHash, prevIndex)
 		if err != nil {
 			log.Println("get transaction err:", err, prevHash.String())
 			continue
 		}
-		value := tx.MsgTx().TxOut[prevIndex].Value
+		value := prev.Value
 		fee += uint64(value)
 
-		script := tx.MsgTx().TxOut[prevIndex].PkScript
+		script := prev.Script
 		_, addrSet, _, err := txscript.ExtractPkScriptAddrs(
 			script, param)
 		if err != nil {
@@ -115,8 +175,17 @@ func ParseTransaction(client *rpcclient.Client, msgtx *wire.MsgTx, chainName str
 		path, ok := util.LoadAddrPath(addrStr)
 		if ok {
 			inputAddrs = append(inputAddrs, addrStr)
-			removeUtxo(prevHash.String(), prevIndex, addrStr, value)
-			if strings.Index(path, "0/") == 0 {
+			spent, err := removeUtxo(prevHash.String(), prevIndex)
+			if err != nil {
+				// spent in mempool before
+				spent = &Utxo{Hash: prevHash.String(), Index: prevIndex, Address: addrStr, Value: value, Script: script, Path: path.String()}
+				forgetMempoolSpent(prevHash.String(), prevIndex)
+			}
+			if undo != nil {
+				undo.Spent = append(undo.Spent, *spent)
+				undo.Spenders[outpointKey(prevHash.String(), prevIndex)] = hash
+			}
+			if path.IsExternal() {
 				extInputAddrNum++
 			}
 		} else {
@@ -158,12 +227,18 @@ func ParseTransaction(client *rpcclient.Client, msgtx *wire.MsgTx, chainName str
 		_, ok := util.LoadAddrPath(addrStr)
 		if ok {
 			outputAddrs = append(outputAddrs, addrStr)
-			createUtxo(hash, uint32(i), addrStr, msgtx.TxOut[i].Value)
+			utxo := Utxo{Hash: hash, Index: uint32(i), Address: addrStr, Value: msgtx.TxOut[i].Value, Script: msgtx.TxOut[i].PkScript}
+			if undo != nil {
+				utxo.Height = undo.Height
+				undo.Created = append(undo.Created, utxo)
+			}
+			createUtxo(utxo)
 		} else {
 			outputAddrs2 = append(outputAddrs2, addrStr)
 		}
 
 		outputValue[addrStr] = msgtx.TxOut[i].Value
+		outputIndex[addrStr] = uint32(i)
 
 		if omniReceiver == "" {
 			if addrStr == omniSender {
@@ -193,14 +268,14 @@ func ParseTransaction(client *rpcclient.Client, msgtx *wire.MsgTx, chainName str
 		txType := TYPE_NONE
 		if !senderExist && receiverExist {
 			path, _ := util.LoadAddrPath(omniReceiver)
-			if strings.Index(path, "0/") == 0 {
+			if path.IsExternal() {
 				txType = TYPE_USER_DEPOSIT
 			} else {
 				txType = TYPE_ADMIN_DEPOSIT
 			}
 		} else if senderExist && !receiverExist {
 			path, _ := util.LoadAddrPath(omniSender)
-			if strings.Index(path, "0/") == 0 {
+			if path.IsExternal() {
 				txType = TYPE_ADMIN_WITHDRAW
 			} else {
 				txType = TYPE_USER_WITHDRAW
@@ -236,7 +311,7 @@ func ParseTransaction(client *rpcclient.Client, msgtx *wire.MsgTx, chainName str
 		log.Println("deposit tx found")
 		for i := 0; i < len(outputAddrs); i++ {
 			path, _ := util.LoadAddrPath(outputAddrs[i])
-			if strings.Index(path, "0/") == 0 {
+			if path.IsExternal() {
 				message.TxType = TYPE_USER_DEPOSIT
 			} else {
 				message.TxType = TYPE_ADMIN_DEPOSIT
@@ -254,10 +329,13 @@ func ParseTransaction(client *rpcclient.Client, msgtx *wire.MsgTx, chainName str
 			message.TxType = TYPE_ADMIN_WITHDRAW
 		}
 
+		message.OrigTxHash = originalTxHash(hash)
+		// outputs of a batch withdrawal pay different requests
+		batch, _ := getBatch(hash)
 		for i := 0; i < len(outputAddrs2); i++ {
 			message.Address = outputAddrs2[i]
 			message.Amount = big.NewInt(outputValue[message.Address])
-			messages = append(messages, message)
+			messages = append(messages, attributeBatch(batch, message, outputIndex[message.Address]))
 		}
 	} else if len(inputAddrs2) == 0 && len(outputAddrs2) == 0 {
 		log.Println("inner tx found:", hash)
@@ -275,6 +353,7 @@ func ParseTransaction(client *rpcclient.Client, msgtx *wire.MsgTx, chainName str
 func ReadBlock(client *rpcclient.Client, block *big.Int, chainName string) ([]NotifyMessage, error) {
 	var err error
 	messages := make([]NotifyMessage, 0)
+	height := block.Uint64()
 
 	hash, err := client.GetBlockHash(block.Int64())
 	if err != nil {
@@ -286,19 +365,49 @@ func ReadBlock(client *rpcclient.Client, block *big.Int, chainName string) ([]No
 		return messages, fmt.Errorf("get block err: %v", err)
 	}
 
+	return processBlock(newPrevoutCache(client, blockInfo, nil), height, blockInfo, chainName, true)
+}
+
+// processBlock applies a block read from the node to the wallet. Without
+// notify the messages are left out of the undo record, so that a rollback
+// has nothing to revert for blocks which were never notified.
+func processBlock(prevouts *PrevoutCache, height uint64, blockInfo *wire.MsgBlock, chainName string, notify bool) ([]NotifyMessage, error) {
+	messages := make([]NotifyMessage, 0)
+	hash := blockInfo.BlockHash()
+
+	// the block must extend the header chain we have already processed
+	stored, err := getBlockHash(height)
+	if err == nil && stored != hash.String() {
+		return messages, errChainReorg
+	}
+	if height > 0 {
+		stored, err = getBlockHash(height - 1)
+		if err == nil && stored != blockInfo.Header.PrevBlock.String() {
+			return messages, errChainReorg
+		}
+	}
+
+	undo := &BlockUndo{Hash: hash.String(), Height: height, Spenders: make(map[string]string)}
 	for i, tx := range blockInfo.Transactions {
 		//ignore coin base
 		if i == 0 {
 			continue
 		}
 		if packHash == "" || packHash == tx.TxHash().String() {
-			message, err := ParseTransaction(client, tx, chainName, uint64(blockInfo.Header.Timestamp.Unix()))
+			message, err := ParseTransaction(prevouts, tx, chainName, uint64(blockInfo.Header.Timestamp.Unix()), undo)
 			if err == nil {
 				messages = append(messages, message...)
 			}
 		}
 	}
 
+	if notify {
+		undo.Messages = messages
+	}
+	if err := saveBlockUndo(height, undo); err != nil {
+		log.Println("save block undo err:", err, height)
+	}
+
 	return messages, nil
 }
 
@@ -324,13 +433,8 @@ func ParseMempoolTransaction(config *conf.Config, msgtx *wire.MsgTx, chainName s
 		return fmt.Errorf("Transaction is nil: Can't parse.")
 	}
 
-	client, err := ConnectRPC(config)
-	if err != nil {
-		return err
-	}
-	defer client.Shutdown()
-
 	hash := msgtx.TxHash().String()
+	// only our own outpoints matter, they are all in the utxo set
 	for i := 0; i < len(msgtx.TxIn); i++ {
 		prevHash := msgtx.TxIn[i].PreviousOutPoint.Hash
 		prevIndex := msgtx.TxIn[i].PreviousOutPoint.Index
@@ -338,29 +442,7 @@ func ParseMempoolTransaction(config *conf.Config, msgtx *wire.MsgTx, chainName s
 		if prevIndex == 0xFFFFFFFF {
 			continue
 		}
-		tx, err := client.GetRawTransaction(&prevHash)
-		if err != nil {
-			continue
-		}
-		value := tx.MsgTx().TxOut[prevIndex].Value
-
-		script := tx.MsgTx().TxOut[prevIndex].PkScript
-		_, addrSet, _, err := txscript.ExtractPkScriptAddrs(
-			script, param)
-		if err != nil {
-			log.Println("parse input pkscript err:", err, hash, i)
-			continue
-		}
-
-		addrStr := addrSet[0].EncodeAddress()
-		if strings.HasPrefix(strings.ToLower(chainName), "bch") {
-			addrStr, _ = util.ConvertLegacyToCashAddr(addrStr, param)
-			addrStr = addrStr[len(param.Bech32HRPSegwit)+1:]
-		}
-		_, ok := util.LoadAddrPath(addrStr)
-		if ok {
-			removeUtxo(prevHash.String(), prevIndex, addrStr, value)
-		}
+		spendMempoolUtxo(prevHash.String(), prevIndex)
 	}
 
 	for i := 0; i < len(msgtx.TxOut); i++ {
@@ -387,7 +469,7 @@ func ParseMempoolTransaction(config *conf.Config, msgtx *wire.MsgTx, chainName s
 		}
 		_, ok := util.LoadAddrPath(addrStr)
 		if ok {
-			createUtxo(hash, uint32(i), addrStr, msgtx.TxOut[i].Value)
+			createUtxo(Utxo{Hash: hash, Index: uint32(i), Address: addrStr, Value: msgtx.TxOut[i].Value, Script: msgtx.TxOut[i].PkScript})
 		}
 	}
 
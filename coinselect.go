@@ -0,0 +1,273 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	conf "github.com/bytefly/dashcash-wallet/config"
+	"net/http"
+	"sort"
+)
+
+const (
+	SELECT_FIRST_FIT     = "firstfit"
+	SELECT_BNB           = "bnb"
+	SELECT_LARGEST_FIRST = "largest"
+	SELECT_OLDEST_FIRST  = "oldest"
+	SELECT_PRIVACY       = "privacy"
+
+	// give up the branch and bound search after so many steps
+	BNB_MAX_TRIES = 100000
+)
+
+var errInsufficientFunds = errors.New("insufficient funds")
+
+// SelectionParams describes what the selected utxos have to pay for. All the
+// amounts are in satoshis.
+type SelectionParams struct {
+	// outputs plus the fee of the tx without the selected inputs and change
+	Target int64
+	// fee of adding the change output
+	ChangeCost int64
+	// smallest change output worth creating
+	MinChange int64
+	FeePerKb  uint32
+}
+
+// inputFee returns the fee of spending the utxo.
+func (p *SelectionParams) inputFee(u *Utxo) int64 {
+	weight, _ := inputWeight(u.Script)
+	return txFee(p.FeePerKb, (weight+WITNESS_SCALE_FACTOR-1)/WITNESS_SCALE_FACTOR)
+}
+
+// effectiveValue returns what the utxo adds to the tx after its own fee.
+func (p *SelectionParams) effectiveValue(u *Utxo) int64 {
+	return u.Value - p.inputFee(u)
+}
+
+// CoinSelector picks the utxos funding a tx out of the candidates.
+type CoinSelector interface {
+	Select(utxos []Utxo, p *SelectionParams) ([]Utxo, error)
+}
+
+func GetCoinSelector(name string) (CoinSelector, error) {
+	switch name {
+	case SELECT_FIRST_FIT, "":
+		return firstFitSelector{}, nil
+	case SELECT_BNB:
+		return branchAndBoundSelector{}, nil
+	case SELECT_LARGEST_FIRST:
+		return largestFirstSelector{}, nil
+	case SELECT_OLDEST_FIRST:
+		return oldestFirstSelector{}, nil
+	case SELECT_PRIVACY:
+		return privacySelector{}, nil
+	}
+	return nil, fmt.Errorf("unknown coin selection strategy: %s", name)
+}
+
+// coinSelectorFromRequest returns the strategy asked by the strategy parameter
+// of a parsed request, or the one configured for the endpoint.
+func coinSelectorFromRequest(config *conf.Config, endpoint string, r *http.Request) (CoinSelector, error) {
+	if name := r.Form.Get("strategy"); name != "" {
+		return GetCoinSelector(name)
+	}
+	return coinSelectorFor(config, endpoint)
+}
+
+// coinSelectorFor returns the strategy configured for the endpoint.
+func coinSelectorFor(config *conf.Config, endpoint string) (CoinSelector, error) {
+	if name, ok := config.CoinSelection[endpoint]; ok {
+		return GetCoinSelector(name)
+	}
+	return GetCoinSelector(config.CoinSelection["default"])
+}
+
+// accumulate takes the utxos in order until they fund the tx with a change
+// output, or exactly without one. When it runs out of utxos a tx leaving the
+// remainder to the miners is accepted too.
+func accumulate(utxos []Utxo, p *SelectionParams) ([]Utxo, error) {
+	var total int64
+	selected := make([]Utxo, 0)
+	for i := range utxos {
+		if total == p.Target || total >= p.Target+p.ChangeCost+p.MinChange {
+			break
+		}
+		eff := p.effectiveValue(&utxos[i])
+		if eff <= 0 {
+			continue
+		}
+		selected = append(selected, utxos[i])
+		total += eff
+	}
+
+	if total >= p.Target {
+		return selected, nil
+	}
+	return nil, errInsufficientFunds
+}
+
+// firstFitSelector takes the utxos in db order.
+type firstFitSelector struct{}
+
+func (firstFitSelector) Select(utxos []Utxo, p *SelectionParams) ([]Utxo, error) {
+	return accumulate(utxos, p)
+}
+
+// largestFirstSelector spends the biggest utxos first, using the fewest inputs.
+type largestFirstSelector struct{}
+
+func (largestFirstSelector) Select(utxos []Utxo, p *SelectionParams) ([]Utxo, error) {
+	sorted := append([]Utxo(nil), utxos...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Value > sorted[j].Value
+	})
+	return accumulate(sorted, p)
+}
+
+// oldestFirstSelector spends the utxos with the lowest block height first,
+// unconfirmed ones last.
+type oldestFirstSelector struct{}
+
+func (oldestFirstSelector) Select(utxos []Utxo, p *SelectionParams) ([]Utxo, error) {
+	sorted := append([]Utxo(nil), utxos...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Height == 0 || sorted[j].Height == 0 {
+			return sorted[j].Height == 0 && sorted[i].Height != 0
+		}
+		return sorted[i].Height < sorted[j].Height
+	})
+	return accumulate(sorted, p)
+}
+
+// branchAndBoundSelector searches for a set of utxos paying the target
+// without a change output, wasting at most the cost of the change. It falls
+// back to largest first when there is no such set.
+type branchAndBoundSelector struct{}
+
+func (branchAndBoundSelector) Select(utxos []Utxo, p *SelectionParams) ([]Utxo, error) {
+	candidates := make([]Utxo, 0, len(utxos))
+	values := make([]int64, 0, len(utxos))
+	var available int64
+	for i := range utxos {
+		if eff := p.effectiveValue(&utxos[i]); eff > 0 {
+			candidates = append(candidates, utxos[i])
+			available += eff
+		}
+	}
+	if available < p.Target {
+		return nil, errInsufficientFunds
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return p.effectiveValue(&candidates[i]) > p.effectiveValue(&candidates[j])
+	})
+	for i := range candidates {
+		values = append(values, p.effectiveValue(&candidates[i]))
+	}
+
+	var (
+		best      []bool
+		bestWaste int64 = -1
+		total     int64
+	)
+	upper := p.Target + p.ChangeCost
+	selected := make([]bool, len(candidates))
+	remaining := available
+
+	// depth first over include/exclude of each candidate, largest first
+	var search func(depth int, tries *int)
+	search = func(depth int, tries *int) {
+		*tries++
+		if *tries > BNB_MAX_TRIES || total > upper || total+remaining < p.Target {
+			return
+		}
+		if total >= p.Target {
+			waste := total - p.Target
+			if bestWaste < 0 || waste < bestWaste {
+				bestWaste = waste
+				best = append(best[:0], selected...)
+			}
+			return
+		}
+		if depth == len(candidates) {
+			return
+		}
+
+		remaining -= values[depth]
+		// including a value equal to the previous excluded one gives the
+		// sets already tried with that one included
+		if depth == 0 || values[depth] != values[depth-1] || selected[depth-1] {
+			selected[depth] = true
+			total += values[depth]
+			search(depth+1, tries)
+			total -= values[depth]
+			selected[depth] = false
+		}
+		search(depth+1, tries)
+		remaining += values[depth]
+	}
+	tries := 0
+	search(0, &tries)
+
+	if bestWaste < 0 {
+		return largestFirstSelector{}.Select(utxos, p)
+	}
+
+	result := make([]Utxo, 0)
+	for i, ok := range best {
+		if ok {
+			result = append(result, candidates[i])
+		}
+	}
+	return result, nil
+}
+
+// privacySelector avoids linking addresses together: it spends all the utxos
+// of the smallest single address able to pay, and only merges addresses,
+// largest first, when none can.
+type privacySelector struct{}
+
+func (privacySelector) Select(utxos []Utxo, p *SelectionParams) ([]Utxo, error) {
+	if p.Target <= 0 {
+		return []Utxo{}, nil
+	}
+
+	groups := make(map[string][]Utxo)
+	sums := make(map[string]int64)
+	addrs := make([]string, 0)
+	for i := range utxos {
+		eff := p.effectiveValue(&utxos[i])
+		if eff <= 0 {
+			continue
+		}
+		addr := utxos[i].Address
+		if _, ok := groups[addr]; !ok {
+			addrs = append(addrs, addr)
+		}
+		groups[addr] = append(groups[addr], utxos[i])
+		sums[addr] += eff
+	}
+
+	sort.SliceStable(addrs, func(i, j int) bool {
+		return sums[addrs[i]] < sums[addrs[j]]
+	})
+	for _, addr := range addrs {
+		if sums[addr] == p.Target || sums[addr] >= p.Target+p.ChangeCost+p.MinChange {
+			return groups[addr], nil
+		}
+	}
+
+	var total int64
+	selected := make([]Utxo, 0)
+	for i := len(addrs) - 1; i >= 0; i-- {
+		selected = append(selected, groups[addrs[i]]...)
+		total += sums[addrs[i]]
+		if total >= p.Target+p.ChangeCost+p.MinChange {
+			return selected, nil
+		}
+	}
+	if total >= p.Target {
+		return selected, nil
+	}
+	return nil, errInsufficientFunds
+}
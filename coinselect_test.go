@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// spending a P2PKH utxo at 1000 sat/kB costs 148 satoshis
+const testInputFee = 148
+
+func testUtxos() []Utxo {
+	utxos := []Utxo{
+		{Address: "a", Value: 50000 + testInputFee, Height: 300},
+		{Address: "b", Value: 20000 + testInputFee, Height: 100},
+		{Address: "a", Value: 30000 + testInputFee, Height: 0},
+		{Address: "c", Value: 120000 + testInputFee, Height: 200},
+		{Address: "b", Value: 10000 + testInputFee, Height: 400},
+	}
+	for i := range utxos {
+		utxos[i].Hash = fmt.Sprintf("%064x", i)
+		utxos[i].Index = uint32(i)
+	}
+	return utxos
+}
+
+func testParams(target int64) *SelectionParams {
+	return &SelectionParams{Target: target, ChangeCost: 34, MinChange: 546, FeePerKb: 1000}
+}
+
+func selectedValue(p *SelectionParams, utxos []Utxo) int64 {
+	var total int64
+	for i := range utxos {
+		total += p.effectiveValue(&utxos[i])
+	}
+	return total
+}
+
+func TestFirstFit(t *testing.T) {
+	p := testParams(60000)
+	selected, err := firstFitSelector{}.Select(testUtxos(), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(selected) != 2 || selected[0].Index != 0 || selected[1].Index != 1 {
+		t.Fatal("unexpected selection:", selected)
+	}
+}
+
+func TestLargestFirst(t *testing.T) {
+	p := testParams(60000)
+	selected, err := largestFirstSelector{}.Select(testUtxos(), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(selected) != 1 || selected[0].Index != 3 {
+		t.Fatal("unexpected selection:", selected)
+	}
+}
+
+func TestOldestFirst(t *testing.T) {
+	p := testParams(139000)
+	selected, err := oldestFirstSelector{}.Select(testUtxos(), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(selected) != 2 || selected[0].Index != 1 || selected[1].Index != 3 {
+		t.Fatal("unexpected selection:", selected)
+	}
+
+	// the unconfirmed utxo goes last
+	p = testParams(225000)
+	selected, err = oldestFirstSelector{}.Select(testUtxos(), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(selected) != 5 || selected[4].Index != 2 {
+		t.Fatal("unexpected selection:", selected)
+	}
+}
+
+func TestBranchAndBound(t *testing.T) {
+	// 50000 + 30000 pays exactly without change
+	p := testParams(80000)
+	selected, err := branchAndBoundSelector{}.Select(testUtxos(), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if selectedValue(p, selected) != 80000 || len(selected) != 2 {
+		t.Fatal("unexpected selection:", selected)
+	}
+
+	// 20000 + 10000 wastes less than the change cost
+	p = testParams(29980)
+	selected, err = branchAndBoundSelector{}.Select(testUtxos(), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if selectedValue(p, selected) != 30000 {
+		t.Fatal("unexpected selection:", selected)
+	}
+
+	// no changeless match, falls back to largest first
+	p = testParams(1000)
+	selected, err = branchAndBoundSelector{}.Select(testUtxos(), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(selected) != 1 || selected[0].Index != 3 {
+		t.Fatal("unexpected selection:", selected)
+	}
+}
+
+func TestBranchAndBoundDuplicates(t *testing.T) {
+	utxos := []Utxo{
+		{Address: "a", Value: 7000 + testInputFee},
+		{Address: "b", Value: 7000 + testInputFee},
+		{Address: "c", Value: 3000 + testInputFee},
+	}
+	for i := range utxos {
+		utxos[i].Hash = fmt.Sprintf("%064x", i)
+		utxos[i].Index = uint32(i)
+	}
+
+	tests := []struct {
+		target int64
+		want   int64
+		inputs int
+	}{
+		// skipping both equal values reaches the smaller one
+		{3000, 3000, 1},
+		{7000, 7000, 1},
+		{10000, 10000, 2},
+		{14000, 14000, 2},
+		{17000, 17000, 3},
+	}
+	for _, test := range tests {
+		p := testParams(test.target)
+		selected, err := branchAndBoundSelector{}.Select(utxos, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if selectedValue(p, selected) != test.want || len(selected) != test.inputs {
+			t.Fatal("unexpected selection for", test.target, ":", selected)
+		}
+	}
+}
+
+func TestPrivacy(t *testing.T) {
+	// address a alone pays, all of its utxos are spent
+	p := testParams(70000)
+	selected, err := privacySelector{}.Select(testUtxos(), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(selected) != 2 || selected[0].Address != "a" || selected[1].Address != "a" {
+		t.Fatal("unexpected selection:", selected)
+	}
+
+	// the smallest address able to pay is preferred
+	p = testParams(25000)
+	selected, err = privacySelector{}.Select(testUtxos(), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(selected) != 2 || selected[0].Address != "b" {
+		t.Fatal("unexpected selection:", selected)
+	}
+
+	// merges the largest addresses when none pays alone
+	p = testParams(150000)
+	selected, err = privacySelector{}.Select(testUtxos(), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(selected) != 3 || selected[0].Address != "c" {
+		t.Fatal("unexpected selection:", selected)
+	}
+}
+
+func TestInsufficientFunds(t *testing.T) {
+	names := []string{SELECT_FIRST_FIT, SELECT_BNB, SELECT_LARGEST_FIRST, SELECT_OLDEST_FIRST, SELECT_PRIVACY}
+	for _, name := range names {
+		selector, err := GetCoinSelector(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = selector.Select(testUtxos(), testParams(300000))
+		if err != errInsufficientFunds {
+			t.Fatal(name, "expected insufficient funds, got", err)
+		}
+	}
+
+	if _, err := GetCoinSelector("random"); err == nil {
+		t.Fatal("expected unknown strategy error")
+	}
+}
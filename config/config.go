@@ -1,10 +1,28 @@
 package config
 
 import (
+	"fmt"
 	"gopkg.in/ini.v1"
+	"math/big"
+	"sort"
 	"strconv"
+	"strings"
 )
 
+// ConfirmTier holds amounts at or above Amount for Confirmations blocks.
+type ConfirmTier struct {
+	Amount        int64
+	Confirmations uint64
+}
+
+// CoinPolicy is read from a [confirm.<COIN>] section, unset values are zero
+// and MinAmount is -1.
+type CoinPolicy struct {
+	Confirmations uint64
+	MinAmount     int64
+	Tiers         []ConfirmTier
+}
+
 type Config struct {
 	TestNet   int
 	ChainName string
@@ -19,17 +37,69 @@ type Config struct {
 	AccountId int
 	Index     uint32
 	InIndex   uint32
+	// unused addresses derived past the last used one when discovering
+	// addresses, 0 to skip the discovery at startup
+	GapLimit uint32
+	// height the discovery at startup rescans the blocks from, so addresses
+	// already swept are found too; 0 looks only at unspent outputs
+	DiscoverFrom int64
 
 	LastBlock    uint64
 	FeeRate      uint32
 	RegistryAddr string
 	ZmqURL       string
 	DBDir        string
+	// seconds a utxo stays reserved for a tx waiting for signature
+	ReserveTimeout uint32
+	// seconds between two checks of the broadcast txs
+	TxCheckInterval uint32
+	// blocks requested from the node at once while catching up
+	FetchWorkers int
+
+	// confirmation targets for estimatesmartfee and bounds of the fee rate
+	FeeTargetFast    uint32
+	FeeTargetNormal  uint32
+	FeeTargetEconomy uint32
+	MinFeeRate       uint32
+	MaxFeeRate       uint32
+	// signal replace-by-fee on BTC withdrawals
+	EnableRBF bool
+	// fee rate (satoshis per kB) deciding which outputs are dust
+	DustRelayFee uint32
+
+	// coin selection strategy by endpoint name, "default" for the others
+	CoinSelection map[string]string
+
+	// the withdrawal queue is drained every WithdrawInterval seconds or once
+	// WithdrawBatchSize requests are waiting
+	WithdrawInterval   uint32
+	WithdrawBatchSize  uint32
+	WithdrawMaxOutputs uint32
+	WithdrawFeeTarget  string
+
+	// sweep of the deposit addresses into the inner ones
+	SweepEnable    bool
+	SweepInterval  uint32
+	SweepMinAmount int64
+	SweepMaxInputs uint32
+	SweepFeeTarget string
+
+	// consolidation of the inner utxos while the fee rate (satoshis per kB)
+	// is at most ConsolidateMaxFeeRate
+	ConsolidateEnable     bool
+	ConsolidateInterval   uint32
+	ConsolidateMaxFeeRate uint32
+	ConsolidateTarget     uint32
+	ConsolidateMaxInputs  uint32
+	ConsolidateMaxFee     int64
+	ConsolidateFeeTarget  string
 
 	DBHost string
 	DBName string
 	DBUser string
 	DBPass string
+
+	Coins map[string]*CoinPolicy
 }
 
 var cfg *ini.File
@@ -56,23 +126,129 @@ func LoadConfiguration(filepath string) (*Config, error) {
 	config.AccountId = cfg.Section("account").Key("id").MustInt(0)
 	config.Index = uint32(cfg.Section("account").Key("index").MustInt(0))
 	config.InIndex = uint32(cfg.Section("account").Key("change_index").MustInt(0))
+	config.GapLimit = uint32(cfg.Section("account").Key("gap_limit").MustInt(20))
+	config.DiscoverFrom = cfg.Section("account").Key("discover_from").MustInt64(0)
 
 	config.LastBlock = uint64(cfg.Section("extapi").Key("lastBlock").MustInt(0))
 	config.FeeRate = uint32(cfg.Section("extapi").Key("feerate").MustInt(0))
 	config.RegistryAddr = cfg.Section("extapi").Key("registry").String()
 	config.ZmqURL = cfg.Section("extapi").Key("zmq").String()
 	config.DBDir = cfg.Section("extapi").Key("dbDir").String()
+	config.ReserveTimeout = uint32(cfg.Section("extapi").Key("reserve_timeout").MustInt(3600))
+	config.TxCheckInterval = uint32(cfg.Section("extapi").Key("tx_check_interval").MustInt(60))
+	config.FetchWorkers = cfg.Section("extapi").Key("fetch_workers").MustInt(4)
+
+	config.FeeTargetFast = uint32(cfg.Section("fee").Key("fast").MustInt(2))
+	config.FeeTargetNormal = uint32(cfg.Section("fee").Key("normal").MustInt(6))
+	config.FeeTargetEconomy = uint32(cfg.Section("fee").Key("economy").MustInt(24))
+	config.MinFeeRate = uint32(cfg.Section("fee").Key("min").MustInt(0))
+	config.MaxFeeRate = uint32(cfg.Section("fee").Key("max").MustInt(0))
+	config.EnableRBF = cfg.Section("fee").Key("rbf").MustBool(false)
+	config.DustRelayFee = uint32(cfg.Section("fee").Key("dust_relay_fee").MustInt(3000))
+
+	config.WithdrawInterval = uint32(cfg.Section("withdraw").Key("interval").MustInt(60))
+	config.WithdrawBatchSize = uint32(cfg.Section("withdraw").Key("batch_size").MustInt(50))
+	config.WithdrawMaxOutputs = uint32(cfg.Section("withdraw").Key("max_outputs").MustInt(200))
+	config.WithdrawFeeTarget = cfg.Section("withdraw").Key("fee_target").MustString("normal")
+
+	config.SweepEnable = cfg.Section("sweep").Key("enable").MustBool(false)
+	config.SweepInterval = uint32(cfg.Section("sweep").Key("interval").MustInt(3600))
+	config.SweepMaxInputs = uint32(cfg.Section("sweep").Key("max_inputs").MustInt(100))
+	config.SweepFeeTarget = cfg.Section("sweep").Key("fee_target").MustString("economy")
+	if str := cfg.Section("sweep").Key("min_amount").String(); str != "" {
+		if config.SweepMinAmount, err = parseAmount(str); err != nil {
+			return nil, fmt.Errorf("sweep min_amount: %v", err)
+		}
+	}
+
+	config.ConsolidateEnable = cfg.Section("consolidate").Key("enable").MustBool(false)
+	config.ConsolidateInterval = uint32(cfg.Section("consolidate").Key("interval").MustInt(600))
+	config.ConsolidateMaxFeeRate = uint32(cfg.Section("consolidate").Key("max_fee_rate").MustInt(2000))
+	config.ConsolidateTarget = uint32(cfg.Section("consolidate").Key("target_utxos").MustInt(20))
+	config.ConsolidateMaxInputs = uint32(cfg.Section("consolidate").Key("max_inputs").MustInt(200))
+	config.ConsolidateFeeTarget = cfg.Section("consolidate").Key("fee_target").MustString("economy")
+	if str := cfg.Section("consolidate").Key("max_fee").String(); str != "" {
+		if config.ConsolidateMaxFee, err = parseAmount(str); err != nil {
+			return nil, fmt.Errorf("consolidate max_fee: %v", err)
+		}
+	}
+
+	config.CoinSelection = make(map[string]string)
+	for _, key := range cfg.Section("coinselect").Keys() {
+		config.CoinSelection[key.Name()] = strings.ToLower(key.String())
+	}
 
 	config.DBHost = cfg.Section("db").Key("host").String()
 	config.DBName = cfg.Section("db").Key("name").String()
 	config.DBUser = cfg.Section("db").Key("user").String()
 	config.DBPass = cfg.Section("db").Key("pass").String()
+
+	config.Coins = make(map[string]*CoinPolicy)
+	for _, section := range cfg.Sections() {
+		if !strings.HasPrefix(section.Name(), "confirm.") {
+			continue
+		}
+		policy, err := loadCoinPolicy(section)
+		if err != nil {
+			return nil, fmt.Errorf("section %s: %v", section.Name(), err)
+		}
+		config.Coins[strings.ToUpper(section.Name()[len("confirm."):])] = policy
+	}
 	return config, nil
 }
 
+// loadCoinPolicy parses a section like:
+//
+//	confirmations = 3
+//	min_amount = 0.001
+//	tiers = 0:1, 0.1:3, 10:6
+func loadCoinPolicy(section *ini.Section) (*CoinPolicy, error) {
+	var err error
+	policy := &CoinPolicy{MinAmount: -1}
+	policy.Confirmations = section.Key("confirmations").MustUint64(0)
+
+	if str := section.Key("min_amount").String(); str != "" {
+		policy.MinAmount, err = parseAmount(str)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, item := range section.Key("tiers").Strings(",") {
+		pos := strings.IndexByte(item, ':')
+		if pos < 0 {
+			return nil, fmt.Errorf("invalid tier: %s", item)
+		}
+		amount, err := parseAmount(item[:pos])
+		if err != nil {
+			return nil, err
+		}
+		confirmations, err := strconv.ParseUint(strings.TrimSpace(item[pos+1:]), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tier: %s", item)
+		}
+		policy.Tiers = append(policy.Tiers, ConfirmTier{amount, confirmations})
+	}
+	sort.Slice(policy.Tiers, func(i, j int) bool {
+		return policy.Tiers[i].Amount < policy.Tiers[j].Amount
+	})
+
+	return policy, nil
+}
+
+// parseAmount converts a decimal coin amount into satoshis.
+func parseAmount(str string) (int64, error) {
+	r, ok := new(big.Rat).SetString(strings.TrimSpace(str))
+	if !ok {
+		return 0, fmt.Errorf("invalid amount: %s", str)
+	}
+	r.Mul(r, big.NewRat(100000000, 1))
+	return new(big.Int).Quo(r.Num(), r.Denom()).Int64(), nil
+}
+
 func SaveConfiguration(config *Config, filepath string) {
 	cfg.Section("account").Key("index").SetValue(strconv.FormatInt(int64(config.Index), 10))
 	cfg.Section("account").Key("change_index").SetValue(strconv.FormatInt(int64(config.InIndex), 10))
-	cfg.Section("extapi").Key("lastBlock").SetValue(strconv.FormatUint(config.LastBlock-3, 10))
+	cfg.Section("extapi").Key("lastBlock").SetValue(strconv.FormatUint(config.LastBlock, 10))
 	cfg.SaveTo(filepath)
 }
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	conf "github.com/bytefly/dashcash-wallet/config"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	badger "github.com/dgraph-io/badger"
+)
+
+const (
+	// consolidation/<seq> holds the reports of runs which sent txs
+	CONSOLIDATION_KEY_PREFIX = "consolidation/"
+	CONSOLIDATION_SEQ_KEY    = "meta/consolidationSeq"
+	// reports returned by /consolidations
+	MAX_CONSOLIDATION_REPORTS = 50
+)
+
+// ConsolidationReport tells what a consolidation run did, or why it did
+// nothing.
+type ConsolidationReport struct {
+	Time        int64
+	FeeRate     uint32
+	UtxosBefore int
+	UtxosAfter  int
+	Inputs      int
+	Fee         int64
+	Txs         []string
+	Skipped     string
+}
+
+var (
+	lastConsolidation *ConsolidationReport
+	consolidationLock sync.Mutex
+)
+
+func saveConsolidationReport(report *ConsolidationReport) error {
+	buf, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	return db.Update(func(txn *badger.Txn) error {
+		seq, err := nextSequence(txn, CONSOLIDATION_SEQ_KEY)
+		if err != nil {
+			return err
+		}
+		return txn.Set(heightKey(CONSOLIDATION_KEY_PREFIX, seq), buf)
+	})
+}
+
+// consolidationReports returns the latest reports of runs which sent txs,
+// newest first.
+func consolidationReports(limit int) ([]ConsolidationReport, error) {
+	reports := make([]ConsolidationReport, 0)
+	err := db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Reverse = true
+		prefix := []byte(CONSOLIDATION_KEY_PREFIX)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		// reverse iteration starts from the last key under the prefix
+		for it.Seek(append(prefix, 0xff)); it.ValidForPrefix(prefix) && len(reports) < limit; it.Next() {
+			err := it.Item().Value(func(v []byte) error {
+				var r ConsolidationReport
+				if err := json.Unmarshal(v, &r); err != nil {
+					return err
+				}
+				reports = append(reports, r)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return reports, err
+}
+
+// consolidate merges the smallest confirmed inner utxos until no more than
+// ConsolidateTarget are left, spending at most ConsolidateMaxFee. Unless
+// forced it does nothing while the fee rate is above ConsolidateMaxFeeRate.
+// The caller holds m.
+func consolidate(config *conf.Config, feeRate uint32, force bool) *ConsolidationReport {
+	report := &ConsolidationReport{Time: time.Now().Unix(), FeeRate: feeRate, Txs: make([]string, 0)}
+	defer func() {
+		consolidationLock.Lock()
+		lastConsolidation = report
+		consolidationLock.Unlock()
+	}()
+
+	if !force && config.ConsolidateMaxFeeRate > 0 && feeRate > config.ConsolidateMaxFeeRate {
+		report.Skipped = fmt.Sprintf("fee rate %d above %d", feeRate, config.ConsolidateMaxFeeRate)
+		return report
+	}
+
+	utxos, err := GetAllUtxoByBranch(1, false)
+	if err != nil {
+		report.Skipped = err.Error()
+		return report
+	}
+	count := len(utxos)
+	report.UtxosBefore = count
+
+	// only confirmed utxos worth more than the fee of spending them
+	p := SelectionParams{FeePerKb: feeRate}
+	candidates := make([]Utxo, 0)
+	utxos, err = filterReserved(utxos)
+	if err != nil {
+		report.Skipped = err.Error()
+		return report
+	}
+	for _, u := range utxos {
+		if u.Height > 0 && p.effectiveValue(&u) > 0 {
+			candidates = append(candidates, u)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Value < candidates[j].Value
+	})
+
+	target := int(config.ConsolidateTarget)
+	if target < 1 {
+		target = 1
+	}
+	maxInputs := int(config.ConsolidateMaxInputs)
+	if maxInputs < 2 {
+		maxInputs = len(candidates)
+	}
+	changeAddress, changeScript, err := innerChangeScript(config)
+	if err != nil {
+		report.Skipped = err.Error()
+		return report
+	}
+
+	for count > target && len(candidates) >= 2 {
+		// merging k utxos into one removes k-1 of them
+		k := count - target + 1
+		if k > maxInputs {
+			k = maxInputs
+		}
+		if k > len(candidates) {
+			k = len(candidates)
+		}
+
+		var fee int64
+		for ; k >= 2; k-- {
+			tx, err := buildMergeTx(candidates[:k], changeScript, feeRate)
+			if err != nil {
+				continue
+			}
+			fee = -tx.TxOut[0].Value
+			for _, u := range candidates[:k] {
+				fee += u.Value
+			}
+			if config.ConsolidateMaxFee <= 0 || report.Fee+fee <= config.ConsolidateMaxFee {
+				break
+			}
+		}
+		if k < 2 {
+			report.Skipped = "fee budget exhausted"
+			break
+		}
+
+		tx, _ := buildMergeTx(candidates[:k], changeScript, feeRate)
+		signedTx, err := SignMsgTx(config.ChainName, config.Xpriv, tx)
+		if err != nil {
+			report.Skipped = err.Error()
+			break
+		}
+		hash, err := broadcastTx(config, signedTx, feeRate)
+		if err != nil {
+			report.Skipped = fmt.Sprintf("send tx err:%v", err)
+			break
+		}
+		useChangeAddress(config, changeAddress)
+		// recorded as a fund collection of user id 0 like a sweep
+		s, err := getSentTx(hash)
+		if err != nil {
+			s = newSentTx(signedTx, candidates[:k], feeRate)
+		}
+		s.Sweep = true
+		if err = saveSentTx(s); err != nil {
+			log.Println("save sent tx err:", err, hash)
+		}
+		log.Println("consolidate", k, "utxos by", hash, "fee:", fee)
+
+		report.Txs = append(report.Txs, hash)
+		report.Inputs += k
+		report.Fee += fee
+		count -= k - 1
+		candidates = candidates[k:]
+	}
+	report.UtxosAfter = count
+
+	if len(report.Txs) == 0 {
+		if report.Skipped == "" {
+			report.Skipped = "nothing to consolidate"
+		}
+		return report
+	}
+	if err = saveConsolidationReport(report); err != nil {
+		log.Println("save consolidation report err:", err)
+	}
+	return report
+}
+
+// runConsolidation consolidates at the fee rate estimated by the node. The
+// static fee rate says nothing about the fees being low, so the run is
+// skipped when the node cannot estimate.
+func runConsolidation(config *conf.Config) {
+	feeRate, err := NodeFeeRate(config, config.ConsolidateFeeTarget)
+	if err != nil {
+		log.Println("estimate consolidation fee err:", err)
+		consolidationLock.Lock()
+		lastConsolidation = &ConsolidationReport{Time: time.Now().Unix(), Txs: make([]string, 0), Skipped: fmt.Sprintf("no fee estimation: %v", err)}
+		consolidationLock.Unlock()
+		return
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	consolidate(config, feeRate, false)
+}
+
+// ConsolidationScheduler consolidates the inner utxos every interval until
+// quit is closed.
+func ConsolidationScheduler(config *conf.Config, quit <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	interval := config.ConsolidateInterval
+	if interval == 0 {
+		interval = 1
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+		runConsolidation(config)
+	}
+}
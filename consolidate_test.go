@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestConsolidationReports(t *testing.T) {
+	if err := openDb(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer closeDb()
+
+	// reports saved within the same clock tick are all kept
+	for i := 1; i <= 3; i++ {
+		if err := saveConsolidationReport(&ConsolidationReport{Time: 1, Inputs: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		limit  int
+		inputs []int
+	}{
+		{10, []int{3, 2, 1}},
+		{2, []int{3, 2}},
+		{0, []int{}},
+	}
+	for _, c := range cases {
+		reports, err := consolidationReports(c.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(reports) != len(c.inputs) {
+			t.Fatalf("limit %d: %d reports, want %d", c.limit, len(reports), len(c.inputs))
+		}
+		for i, r := range reports {
+			if r.Inputs != c.inputs[i] {
+				t.Fatalf("limit %d: report %d has %d inputs, want %d", c.limit, i, r.Inputs, c.inputs[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	conf "github.com/bytefly/dashcash-wallet/config"
+	"github.com/bytefly/dashcash-wallet/util"
+	"log"
+	"strings"
+
+	badger "github.com/dgraph-io/badger"
+)
+
+// Acceleration describes a child tx and the package it forms with its
+// unconfirmed ancestors.
+type Acceleration struct {
+	Tx          *SentTx
+	Parent      string
+	PackageFee  int64
+	PackageSize int64
+	// satoshis per kB
+	PackageRate int64
+}
+
+// ancestorFees returns the fees in satoshis of the tx and its unconfirmed
+// ancestors, newer nodes only report them in BTC under fees.
+func ancestorFees(entry *btcjson.GetMempoolEntryResult) int64 {
+	if entry.Fees.Ancestor > 0 {
+		return int64(entry.Fees.Ancestor*1e8 + 0.5)
+	}
+	return int64(entry.AncestorFees)
+}
+
+// depositOutputs returns the outputs of the tx paying our deposit addresses,
+// except the frozen ones.
+func depositOutputs(config *conf.Config, tx *wire.MsgTx) []Utxo {
+	param := util.GetParamByName(config.ChainName)
+	hash := tx.TxHash().String()
+	outputs := make([]Utxo, 0)
+	for i, out := range tx.TxOut {
+		_, addrSet, _, err := txscript.ExtractPkScriptAddrs(out.PkScript, param)
+		if err != nil || len(addrSet) == 0 {
+			continue
+		}
+
+		addrStr := addrSet[0].EncodeAddress()
+		if strings.HasPrefix(strings.ToLower(config.ChainName), "bch") {
+			addrStr, _ = util.ConvertLegacyToCashAddr(addrStr, param)
+			addrStr = addrStr[len(param.Bech32HRPSegwit)+1:]
+		}
+		path, ok := util.LoadAddrPath(addrStr)
+		if !ok || !path.IsExternal() {
+			continue
+		}
+		frozen := false
+		db.View(func(txn *badger.Txn) error {
+			frozen = isFrozen(txn, hash, uint32(i))
+			return nil
+		})
+		if frozen {
+			continue
+		}
+		outputs = append(outputs, Utxo{Hash: hash, Index: uint32(i), Address: addrStr, Value: out.Value, Script: out.PkScript, Path: path.String()})
+	}
+	return outputs
+}
+
+// accelerate spends the outputs of the unconfirmed deposit txid paying our
+// deposit addresses to a change address, with a fee lifting the package of
+// the deposit and its ancestors to feeRate. The caller holds m.
+func accelerate(config *conf.Config, txid string, feeRate uint32) (*Acceleration, error) {
+	hash, err := chainhash.NewHashFromStr(txid)
+	if err != nil {
+		return nil, errors.New("invalid txid")
+	}
+
+	client, err := ConnectRPC(config)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Shutdown()
+
+	entry, err := client.GetMempoolEntry(txid)
+	if err != nil {
+		return nil, errors.New("tx is not in the mempool")
+	}
+	parent, err := client.GetRawTransaction(hash)
+	if err != nil {
+		return nil, fmt.Errorf("get tx err: %v", err)
+	}
+
+	inputs := depositOutputs(config, parent.MsgTx())
+	if len(inputs) == 0 {
+		return nil, errors.New("tx does not pay our deposit addresses")
+	}
+
+	changeAddress, changeScript, err := innerChangeScript(config)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := wire.NewMsgTx(wire.TxVersion)
+	spent := make(map[string]*TxOut)
+	scripts := make([][]byte, 0, len(inputs))
+	var balance int64
+	for _, u := range inputs {
+		tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(hash, u.Index), nil, nil))
+		scripts = append(scripts, u.Script)
+		spent[outpointKey(u.Hash, u.Index)] = &TxOut{Address: u.Address, Amount: u.Value, Script: u.Script}
+		balance += u.Value
+	}
+	vsize := estimateVSize(tx, scripts, changeScript)
+
+	// the child pays what the ancestors lack, and at least the rate itself
+	ancestorSize := entry.AncestorSize
+	if ancestorSize == 0 {
+		ancestorSize = int64(entry.VSize)
+	}
+	packageSize := ancestorSize + vsize
+	fee := txFee(feeRate, packageSize) - ancestorFees(entry)
+	if min := txFee(feeRate, vsize); fee < min {
+		fee = min
+	}
+	if balance-fee < minOutputAmount(feeRate) {
+		return nil, errors.New("deposit too small to pay the fee")
+	}
+	tx.AddTxOut(wire.NewTxOut(balance-fee, changeScript))
+
+	signedTx, err := signMsgTx(config.ChainName, config.Xpriv, tx, func(hash string, index uint32) (*TxOut, error) {
+		if out, ok := spent[outpointKey(hash, index)]; ok {
+			return out, nil
+		}
+		return nil, badger.ErrKeyNotFound
+	}, true)
+	if err != nil {
+		return nil, err
+	}
+
+	childHash, err := SendTransaction(config, signedTx)
+	if err != nil {
+		return nil, fmt.Errorf("send tx err:%v", err)
+	}
+	useChangeAddress(config, changeAddress)
+	child := newSentTx(signedTx, inputs, feeRate)
+	// the child collects the deposit into an inner address like a sweep
+	child.Sweep = true
+	if err = saveSentTx(child); err != nil {
+		log.Println("save sent tx err:", err, childHash)
+	}
+	if err = ParseMempoolTransaction(config, signedTx, config.ChainName); err != nil {
+		log.Println("parse signed tx error:", err)
+	}
+
+	a := &Acceleration{
+		Tx:          child,
+		Parent:      txid,
+		PackageFee:  ancestorFees(entry) + child.Fee,
+		PackageSize: packageSize,
+	}
+	a.PackageRate = a.PackageFee * 1000 / a.PackageSize
+	log.Println("accelerate tx", txid, "by", childHash, "fee:", child.Fee, "package rate:", a.PackageRate)
+	return a, nil
+}
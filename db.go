@@ -1,6 +1,8 @@
 package main
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
@@ -28,6 +30,21 @@ const (
 	TX_MIN_OUTPUT_AMOUNT = (TX_FEE_PER_KB * 3 * (TX_OUTPUT_SIZE + TX_INPUT_SIZE) / 1000)
 	// no tx can be larger than this size in bytes
 	TX_MAX_SIZE = 100000
+
+	UTXO_RECORD_VERSION = 1
+	UTXO_FLAG_CONFIRMED = 1 << 0
+	// dust is frozen until it is spent or abandoned through /dust
+	UTXO_FLAG_FROZEN = 1 << 1
+
+	// utxo/<hash>/<index> holds the record, addr/<address>/<hash>/<index>
+	// and branch/<branch>/<hash>/<index> hold copies of it for the queries
+	UTXO_KEY_PREFIX   = "utxo/"
+	ADDR_KEY_PREFIX   = "addr/"
+	BRANCH_KEY_PREFIX = "branch/"
+	UTXO_VERSION_KEY  = "meta/utxoVersion"
+	// mspent/<hash>/<index> keeps our utxos spent by mempool txs until the
+	// spending tx is mined, conflicted or dropped from the mempool
+	MEMPOOL_SPENT_KEY_PREFIX = "mspent/"
 )
 
 func openDb(dbDir string) error {
@@ -42,132 +59,411 @@ func closeDb() {
 	}
 }
 
-func createUtxo(hash string, index uint32, address string, value int64) error {
-	err := db.Update(func(txn *badger.Txn) error {
-		key := fmt.Sprintf("%s/%d", hash, index)
-		val := fmt.Sprintf("%s:%d", address, value)
+func appendBytes(buf []byte, data []byte) []byte {
+	buf = appendUvarint(buf, uint64(len(data)))
+	return append(buf, data...)
+}
+
+func appendUvarint(buf []byte, x uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], x)
+	return append(buf, tmp[:n]...)
+}
+
+func readUvarint(buf []byte) (uint64, []byte, error) {
+	x, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return 0, nil, errors.New("invalid utxo record")
+	}
+	return x, buf[n:], nil
+}
+
+func readBytes(buf []byte) ([]byte, []byte, error) {
+	size, buf, err := readUvarint(buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	if uint64(len(buf)) < size {
+		return nil, nil, errors.New("invalid utxo record")
+	}
+	return buf[:size], buf[size:], nil
+}
+
+// encodeUtxo serializes a utxo as:
+// version | flags | hash | index | value | height | address | script | path
+func encodeUtxo(u *Utxo) []byte {
+	var flags byte
+	if u.Height > 0 {
+		flags |= UTXO_FLAG_CONFIRMED
+	}
+	if u.Frozen {
+		flags |= UTXO_FLAG_FROZEN
+	}
+
+	buf := make([]byte, 0, 64+len(u.Address)+len(u.Script)+len(u.Path))
+	buf = append(buf, UTXO_RECORD_VERSION, flags)
+	hash, _ := chainhash.NewHashFromStr(u.Hash)
+	buf = append(buf, hash[:]...)
+	buf = appendUvarint(buf, uint64(u.Index))
+	buf = appendUvarint(buf, uint64(u.Value))
+	buf = appendUvarint(buf, u.Height)
+	buf = appendBytes(buf, []byte(u.Address))
+	buf = appendBytes(buf, u.Script)
+	buf = appendBytes(buf, []byte(u.Path))
+	return buf
+}
+
+func decodeUtxo(v []byte) (*Utxo, error) {
+	var (
+		x    uint64
+		data []byte
+		err  error
+	)
+	if len(v) < 2+chainhash.HashSize || v[0] != UTXO_RECORD_VERSION {
+		return nil, errors.New("unknown utxo record version")
+	}
+
+	u := new(Utxo)
+	hash, _ := chainhash.NewHash(v[2 : 2+chainhash.HashSize])
+	u.Hash = hash.String()
+	u.Frozen = v[1]&UTXO_FLAG_FROZEN != 0
+	buf := v[2+chainhash.HashSize:]
+
+	if x, buf, err = readUvarint(buf); err != nil {
+		return nil, err
+	}
+	u.Index = uint32(x)
+	if x, buf, err = readUvarint(buf); err != nil {
+		return nil, err
+	}
+	u.Value = int64(x)
+	if u.Height, buf, err = readUvarint(buf); err != nil {
+		return nil, err
+	}
+	if data, buf, err = readBytes(buf); err != nil {
+		return nil, err
+	}
+	u.Address = string(data)
+	if data, buf, err = readBytes(buf); err != nil {
+		return nil, err
+	}
+	u.Script = append([]byte(nil), data...)
+	if data, _, err = readBytes(buf); err != nil {
+		return nil, err
+	}
+	u.Path = string(data)
+	return u, nil
+}
+
+// nextSequence increments the counter stored at key and returns its new
+// value, starting from 1.
+func nextSequence(txn *badger.Txn, key string) (uint64, error) {
+	var seq uint64
+	item, err := txn.Get([]byte(key))
+	if err == nil {
+		err = item.Value(func(v []byte) error {
+			seq = binary.BigEndian.Uint64(v)
+			return nil
+		})
+	}
+	if err != nil && err != badger.ErrKeyNotFound {
+		return 0, err
+	}
+	seq++
+
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, seq)
+	return seq, txn.Set([]byte(key), buf)
+}
+
+func outpointKey(hash string, index uint32) string {
+	return hash + "/" + strconv.FormatUint(uint64(index), 10)
+}
+
+// parseOutpoint parses an outpoint given as "hash:index".
+func parseOutpoint(str string) (string, uint32, error) {
+	pos := strings.LastIndexByte(str, ':')
+	if pos <= 0 {
+		return "", 0, fmt.Errorf("invalid outpoint %s", str)
+	}
+	hash, err := chainhash.NewHashFromStr(str[:pos])
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid outpoint %s", str)
+	}
+	index, err := strconv.ParseUint(str[pos+1:], 10, 32)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid outpoint %s", str)
+	}
+	return hash.String(), uint32(index), nil
+}
+
+func utxoKey(hash string, index uint32) []byte {
+	return []byte(UTXO_KEY_PREFIX + outpointKey(hash, index))
+}
+
+func addrKeyPrefix(address string) []byte {
+	return []byte(ADDR_KEY_PREFIX + address + "/")
+}
+
+func branchKeyPrefix(branch uint32) []byte {
+	return []byte(fmt.Sprintf("%s%d/", BRANCH_KEY_PREFIX, branch))
+}
+
+// pathBranch returns the branch of the derivation path stored with a utxo.
+func pathBranch(path string) (uint32, bool) {
+	p, err := util.ParseAddrPath(path)
+	return p.Branch, err == nil
+}
+
+func putUtxo(txn *badger.Txn, u *Utxo) error {
+	val := encodeUtxo(u)
+	outpoint := outpointKey(u.Hash, u.Index)
+	err := txn.Set(utxoKey(u.Hash, u.Index), val)
+	if err != nil {
+		return err
+	}
+	err = txn.Set(append(addrKeyPrefix(u.Address), outpoint...), val)
+	if err != nil {
+		return err
+	}
+	if branch, ok := pathBranch(u.Path); ok {
+		err = txn.Set(append(branchKeyPrefix(branch), outpoint...), val)
+	}
+	return err
+}
+
+func deleteUtxo(txn *badger.Txn, u *Utxo) error {
+	outpoint := outpointKey(u.Hash, u.Index)
+	err := txn.Delete(utxoKey(u.Hash, u.Index))
+	if err != nil {
+		return err
+	}
+	err = txn.Delete(append(addrKeyPrefix(u.Address), outpoint...))
+	if err != nil {
+		return err
+	}
+	if branch, ok := pathBranch(u.Path); ok {
+		err = txn.Delete(append(branchKeyPrefix(branch), outpoint...))
+	}
+	return err
+}
 
-		_, err := txn.Get([]byte(key))
+func getUtxo(txn *badger.Txn, hash string, index uint32) (*Utxo, error) {
+	item, err := txn.Get(utxoKey(hash, index))
+	if err != nil {
+		return nil, err
+	}
+
+	var u *Utxo
+	err = item.Value(func(v []byte) error {
+		u, err = decodeUtxo(v)
+		return err
+	})
+	return u, err
+}
+
+// createUtxo stores a new utxo, or marks an unconfirmed one as confirmed.
+func createUtxo(u Utxo) error {
+	if u.Path == "" {
+		if path, ok := util.LoadAddrPath(u.Address); ok {
+			u.Path = path.String()
+		}
+	}
+
+	err := db.Update(func(txn *badger.Txn) error {
+		old, err := getUtxo(txn, u.Hash, u.Index)
 		if err == badger.ErrKeyNotFound {
-			log.Println("add utxo:", hash, index, address)
-			// Use the transaction...
-			err = txn.Set([]byte(key), []byte(val))
+			if isAbandoned(txn, u.Hash, u.Index) {
+				return nil
+			}
+			u.Frozen = isDust(&u)
+			log.Println("add utxo:", u.Hash, u.Index, u.Address, "frozen:", u.Frozen)
+			return putUtxo(txn, &u)
+		} else if err != nil {
 			return err
 		}
 
-		return err
+		if old.Height == 0 && u.Height > 0 {
+			old.Height = u.Height
+			return putUtxo(txn, old)
+		}
+		return nil
 	})
 
 	return err
 }
 
-func removeUtxo(hash string, index uint32, address string, value int64) error {
+func mempoolSpentKey(hash string, index uint32) []byte {
+	return []byte(MEMPOOL_SPENT_KEY_PREFIX + outpointKey(hash, index))
+}
+
+// spendMempoolUtxo removes the utxo spent by a mempool tx, remembering it
+// so that the block mining the tx still sees it as ours.
+func spendMempoolUtxo(hash string, index uint32) (*Utxo, error) {
+	var u *Utxo
 	err := db.Update(func(txn *badger.Txn) error {
-		key := fmt.Sprintf("%s/%d", hash, index)
-		_, err := txn.Get([]byte(key))
-		if err == nil {
-			log.Println("remove utxo:", hash, index, address)
-			err = txn.Delete([]byte(key))
+		var err error
+		u, err = getUtxo(txn, hash, index)
+		if err != nil {
 			return err
 		}
+		log.Println("remove utxo:", hash, index, u.Address)
+		if err = deleteUtxo(txn, u); err != nil {
+			return err
+		}
+		return txn.Set(mempoolSpentKey(hash, index), encodeUtxo(u))
+	})
+
+	return u, err
+}
+
+func getMempoolSpent(txn *badger.Txn, hash string, index uint32) (*Utxo, error) {
+	item, err := txn.Get(mempoolSpentKey(hash, index))
+	if err != nil {
+		return nil, err
+	}
+
+	var u *Utxo
+	err = item.Value(func(v []byte) error {
+		u, err = decodeUtxo(v)
 		return err
 	})
+	return u, err
+}
 
-	return err
+func forgetMempoolSpent(hash string, index uint32) error {
+	return db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(mempoolSpentKey(hash, index))
+	})
 }
 
-func getBalance(address string, useTinyUtxo bool) (*big.Int, error) {
-	balance := new(big.Int)
-	ignoreBalance := new(big.Int)
-	db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-		opts.PrefetchSize = 10
-		it := txn.NewIterator(opts)
-		defer it.Close()
-		for it.Rewind(); it.Valid(); it.Next() {
-			item := it.Item()
-			item.Value(func(v []byte) error {
-				pos := strings.IndexByte(string(v), ':')
-				addr := v[:pos]
-				val := v[pos+1:]
-
-				if address == "" || address == string(addr) {
-					valInt, _ := new(big.Int).SetString(string(val), 10)
-					if useTinyUtxo || valInt.Uint64() > 546 {
-						balance.Add(balance, valInt)
-					} else {
-						ignoreBalance.Add(ignoreBalance, valInt)
-					}
-				}
-				return nil
-			})
+// restoreMempoolSpent puts back the utxo spent by a tx which left the mempool
+// without being mined.
+func restoreMempoolSpent(hash string, index uint32) error {
+	return db.Update(func(txn *badger.Txn) error {
+		u, err := getMempoolSpent(txn, hash, index)
+		if err != nil {
+			return err
 		}
-
-		return nil
+		log.Println("restore utxo:", hash, index, u.Address)
+		if err = putUtxo(txn, u); err != nil {
+			return err
+		}
+		return txn.Delete(mempoolSpentKey(hash, index))
 	})
+}
 
-	if !useTinyUtxo {
-		log.Println("ignore tiny balance:", ignoreBalance.String())
+// isOwnOutpoint tells whether the outpoint is one of our utxos, unspent or
+// spent by a mempool tx.
+func isOwnOutpoint(txn *badger.Txn, hash string, index uint32) bool {
+	if _, err := txn.Get(utxoKey(hash, index)); err == nil {
+		return true
 	}
-	return balance, nil
+	_, err := txn.Get(mempoolSpentKey(hash, index))
+	return err == nil
 }
 
-func getInnerBalance(useTinyUtxo bool) (*big.Int, error) {
-	balance := new(big.Int)
-	ignoreBalance := new(big.Int)
-	db.View(func(txn *badger.Txn) error {
+// removeUtxo deletes the utxo and returns what was stored.
+func removeUtxo(hash string, index uint32) (*Utxo, error) {
+	var u *Utxo
+	err := db.Update(func(txn *badger.Txn) error {
+		var err error
+		u, err = getUtxo(txn, hash, index)
+		if err != nil {
+			return err
+		}
+		log.Println("remove utxo:", hash, index, u.Address)
+		return deleteUtxo(txn, u)
+	})
+
+	return u, err
+}
+
+// iterateUtxo calls fn with every utxo stored under prefix.
+func iterateUtxo(prefix []byte, fn func(u *Utxo)) error {
+	return db.View(func(txn *badger.Txn) error {
 		opts := badger.DefaultIteratorOptions
 		opts.PrefetchSize = 10
 		it := txn.NewIterator(opts)
 		defer it.Close()
-		for it.Rewind(); it.Valid(); it.Next() {
-			item := it.Item()
-			item.Value(func(v []byte) error {
-				pos := strings.IndexByte(string(v), ':')
-				addr := v[:pos]
-				val := v[pos+1:]
-
-				path, ok := util.LoadAddrPath(string(addr))
-				if ok {
-					pos = strings.Index(path, "1/")
-					if pos == 0 {
-						valInt, _ := new(big.Int).SetString(string(val), 10)
-						if useTinyUtxo || valInt.Uint64() > 546 {
-							balance.Add(balance, valInt)
-						} else {
-							ignoreBalance.Add(ignoreBalance, valInt)
-						}
-					}
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			err := it.Item().Value(func(v []byte) error {
+				u, err := decodeUtxo(v)
+				if err != nil {
+					return err
 				}
+				fn(u)
 				return nil
 			})
+			if err != nil {
+				log.Println("invalid utxo record:", string(it.Item().Key()), err)
+			}
 		}
-
 		return nil
 	})
+}
 
-	if !useTinyUtxo {
-		log.Println("ignore tiny balance:", ignoreBalance.String())
+// Balance splits the value of a set of utxos.
+type Balance struct {
+	Spendable *big.Int
+	// frozen by the dust policy
+	Dust *big.Int
+	// frozen by an operator
+	Frozen *big.Int
+}
+
+// getBalance returns the balance of the address, of the whole wallet when
+// address is empty.
+func getBalance(address string, useTinyUtxo bool) (*Balance, error) {
+	prefix := []byte(UTXO_KEY_PREFIX)
+	if address != "" {
+		prefix = addrKeyPrefix(address)
+	}
+	return sumUtxo(prefix, useTinyUtxo)
+}
+
+func getInnerBalance(useTinyUtxo bool) (*Balance, error) {
+	return sumUtxo(branchKeyPrefix(1), useTinyUtxo)
+}
+
+// sumUtxo adds up the utxos under prefix. The dust is summed apart, and
+// counted as spendable too with useTinyUtxo. Frozen utxos are never
+// spendable.
+func sumUtxo(prefix []byte, useTinyUtxo bool) (*Balance, error) {
+	frozen, err := frozenOutpoints()
+	if err != nil {
+		return nil, err
 	}
-	return balance, nil
+
+	b := &Balance{Spendable: new(big.Int), Dust: new(big.Int), Frozen: new(big.Int)}
+	err = iterateUtxo(prefix, func(u *Utxo) {
+		if frozen[outpointKey(u.Hash, u.Index)] {
+			b.Frozen.Add(b.Frozen, big.NewInt(u.Value))
+			return
+		}
+		if u.Frozen {
+			b.Dust.Add(b.Dust, big.NewInt(u.Value))
+		}
+		if useTinyUtxo || !u.Frozen {
+			b.Spendable.Add(b.Spendable, big.NewInt(u.Value))
+		}
+	})
+
+	return b, err
 }
 
 func GetUtxoByKey(hash string, index uint32) (*TxOut, error) {
 	out := new(TxOut)
 	err := db.View(func(txn *badger.Txn) error {
-		key := hash + "/" + strconv.FormatUint(uint64(index), 10)
-		item, err := txn.Get([]byte(key))
+		u, err := getUtxo(txn, hash, index)
 		if err != nil {
 			return err
 		}
 
-		err = item.Value(func(v []byte) error {
-			pos := strings.IndexByte(string(v), ':')
-			out.Address = string(v[:pos])
-			out.Amount, _ = strconv.ParseInt(string(v[pos+1:]), 10, 64)
-			return nil
-		})
-		return err
+		out.Address = u.Address
+		out.Amount = u.Value
+		out.Script = u.Script
+		return nil
 	})
 
 	if err != nil {
@@ -176,88 +472,132 @@ func GetUtxoByKey(hash string, index uint32) (*TxOut, error) {
 	return out, nil
 }
 
+// GetAllUtxo returns the spendable utxos of the address, of the whole wallet
+// when address is empty. Frozen utxos are left out.
 func GetAllUtxo(address string, useTinyUtxo bool) ([]Utxo, error) {
+	prefix := []byte(UTXO_KEY_PREFIX)
+	if address != "" {
+		prefix = addrKeyPrefix(address)
+	}
+	return spendableUtxo(prefix, useTinyUtxo)
+}
+
+func GetAllUtxoByBranch(branch uint32, useTinyUtxo bool) ([]Utxo, error) {
+	return spendableUtxo(branchKeyPrefix(branch), useTinyUtxo)
+}
+
+func spendableUtxo(prefix []byte, useTinyUtxo bool) ([]Utxo, error) {
+	frozen, err := frozenOutpoints()
+	if err != nil {
+		return nil, err
+	}
+
 	utxos := make([]Utxo, 0)
-	db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-		opts.PrefetchSize = 10
-		it := txn.NewIterator(opts)
-		defer it.Close()
-		for it.Rewind(); it.Valid(); it.Next() {
-			item := it.Item()
-			k := item.Key()
-			item.Value(func(v []byte) error {
-				pos := strings.IndexByte(string(k), '/')
-				hash := string(k[:pos])
-				index, _ := strconv.ParseInt(string(k[pos+1:]), 10, 32)
-
-				pos = strings.IndexByte(string(v), ':')
-				addr := string(v[:pos])
-				val, _ := strconv.ParseInt(string(v[pos+1:]), 10, 64)
-
-				if address == "" || address == string(addr) {
-					if useTinyUtxo || val > 546 {
-						utxo := Utxo{Hash: hash, Index: uint32(index), Address: addr, Value: val}
-						utxos = append(utxos, utxo)
-					}
-				}
-				return nil
-			})
+	err = iterateUtxo(prefix, func(u *Utxo) {
+		if frozen[outpointKey(u.Hash, u.Index)] {
+			return
+		}
+		if useTinyUtxo || !u.Frozen {
+			utxos = append(utxos, *u)
 		}
-
-		return nil
 	})
 
-	return utxos, nil
+	return utxos, err
 }
 
-func GetAllUtxoByBranch(branch uint32, useTinyUtxo bool) ([]Utxo, error) {
+// migrateUtxoDb converts the "hash/index" => "address:value" records of the
+// first db layout into versioned records with their indexes. It runs once.
+func migrateUtxoDb(param *chaincfg.Params) error {
+	done := false
+	err := db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get([]byte(UTXO_VERSION_KEY))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		done = err == nil
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if done {
+		return nil
+	}
+
 	utxos := make([]Utxo, 0)
-	db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-		opts.PrefetchSize = 10
-		it := txn.NewIterator(opts)
+	keys := make([][]byte, 0)
+	err = db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
 		defer it.Close()
 		for it.Rewind(); it.Valid(); it.Next() {
 			item := it.Item()
 			k := item.Key()
-			item.Value(func(v []byte) error {
-				pos := strings.IndexByte(string(k), '/')
-				hash := string(k[:pos])
-				index, _ := strconv.ParseInt(string(k[pos+1:]), 10, 32)
-
-				pos = strings.IndexByte(string(v), ':')
-				addr := string(v[:pos])
-				val, _ := strconv.ParseInt(string(v[pos+1:]), 10, 64)
-
-				path, ok := util.LoadAddrPath(string(addr))
-				if ok {
-					pos = strings.Index(path, fmt.Sprintf("%d/", branch))
-					if pos == 0 && (useTinyUtxo || val > 546) {
-						utxo := Utxo{Hash: hash, Index: uint32(index), Address: addr, Value: val}
-						utxos = append(utxos, utxo)
-					}
+			// legacy keys are "hash/index"
+			if len(k) <= 65 || k[64] != '/' {
+				continue
+			}
+			err := item.Value(func(v []byte) error {
+				pos := strings.IndexByte(string(v), ':')
+				if pos < 0 {
+					return errors.New("invalid legacy utxo")
 				}
+				index, err := strconv.ParseUint(string(k[65:]), 10, 32)
+				if err != nil {
+					return err
+				}
+				value, err := strconv.ParseInt(string(v[pos+1:]), 10, 64)
+				if err != nil {
+					return err
+				}
+				u := Utxo{Hash: string(k[:64]), Index: uint32(index), Address: string(v[:pos]), Value: value}
+				if path, ok := util.LoadAddrPath(u.Address); ok {
+					u.Path = path.String()
+				}
+				u.Script, _ = scriptForAddress(u.Address, param)
+				utxos = append(utxos, u)
 				return nil
 			})
+			if err != nil {
+				log.Println("skip legacy utxo:", string(k), err)
+				continue
+			}
+			keys = append(keys, item.KeyCopy(nil))
 		}
-
 		return nil
 	})
+	if err != nil {
+		return err
+	}
 
-	return utxos, nil
-}
+	wb := db.NewWriteBatch()
+	for i := range utxos {
+		val := encodeUtxo(&utxos[i])
+		outpoint := outpointKey(utxos[i].Hash, utxos[i].Index)
+		wb.Set(utxoKey(utxos[i].Hash, utxos[i].Index), val)
+		wb.Set(append(addrKeyPrefix(utxos[i].Address), outpoint...), val)
+		if branch, ok := pathBranch(utxos[i].Path); ok {
+			wb.Set(append(branchKeyPrefix(branch), outpoint...), val)
+		}
+	}
+	for _, k := range keys {
+		wb.Delete(k)
+	}
+	wb.Set([]byte(UTXO_VERSION_KEY), []byte{UTXO_RECORD_VERSION})
+	if err = wb.Flush(); err != nil {
+		return err
+	}
 
-func txFee(feePerKb uint32, size uint32) int64 {
-	// standard fee based on tx size
-	standardFee := int64(size*TX_FEE_PER_KB) / 1000
-	// fee using feePerKb, rounded up to nearest 100 satoshi
-	fee := (((int64(size*feePerKb) / 1000) + 99) / 100) * 100
+	log.Println("migrate utxo db done, utxos:", len(utxos))
+	return nil
+}
 
-	if fee > standardFee {
-		return fee
+// txFee returns the fee of a tx of vsize bytes at feePerKb, never below the
+// min relay fee.
+func txFee(feePerKb uint32, vsize int64) int64 {
+	if feePerKb < TX_FEE_PER_KB {
+		feePerKb = TX_FEE_PER_KB
 	}
-	return standardFee
+	return (vsize*int64(feePerKb) + 999) / 1000
 }
 
 // outputs below this amount are uneconomical due to fees (TX_MIN_OUTPUT_AMOUNT is the absolute minimum output amount)
@@ -269,15 +609,14 @@ func minOutputAmount(feePerKb uint32) int64 {
 	return TX_MIN_OUTPUT_AMOUNT
 }
 
-func CreateTxForOutputs(feePerKb uint32, sender string, outputs []TxOut, changeAddress string, param *chaincfg.Params, useInnerUtxo, useTinyUtxo bool) (*wire.MsgTx, bool) {
+func CreateTxForOutputs(feePerKb uint32, sender string, outputs []TxOut, changeAddress string, param *chaincfg.Params, useInnerUtxo, useTinyUtxo bool, selector CoinSelector) (*wire.MsgTx, bool) {
 	var (
-		totalBalance int64
 		balance      int64
-		cpfpSize     int
 		amount       int64
 		utxos        []Utxo
 		err          error
 		i            int
+		changeScript []byte
 	)
 
 	// caching all utxos may be better
@@ -286,7 +625,16 @@ func CreateTxForOutputs(feePerKb uint32, sender string, outputs []TxOut, changeA
 	} else {
 		utxos, err = GetAllUtxo("", useTinyUtxo)
 	}
-	if err != nil || len(utxos) == 0 {
+	if err != nil {
+		return nil, false
+	}
+	// skip the utxos committed to txs waiting for signature
+	utxos, err = filterReserved(utxos)
+	if err != nil {
+		log.Println(err)
+		return nil, false
+	}
+	if len(utxos) == 0 {
 		return nil, false
 	}
 
@@ -300,13 +648,22 @@ func CreateTxForOutputs(feePerKb uint32, sender string, outputs []TxOut, changeA
 		return nil, false
 	}
 
+	// size the change as a P2PKH output until we know where it goes
+	if changeAddress != "" {
+		changeScript, _ = getScriptFromAddress(changeAddress, param)
+	}
+	if len(changeScript) == 0 {
+		changeScript = make([]byte, 25)
+	}
+
 	var usedUtxo Utxo
 	inputs := make([]TxInput, 0)
+	// scripts spent by the inputs of tx, used to estimate the signed size
+	scripts := make([][]byte, 0)
 	for _, o := range utxos {
-		if (sender == "" && o.Value <= 546 && useTinyUtxo) || o.Value > 546 {
+		if (sender == "" && useTinyUtxo) || !o.Frozen {
 			utxos[i] = o
 			i++
-			totalBalance += o.Value
 		}
 		if len(inputs) == 0 && o.Address == sender {
 			usedUtxo = o
@@ -314,62 +671,66 @@ func CreateTxForOutputs(feePerKb uint32, sender string, outputs []TxOut, changeA
 			utxoHash, _ := chainhash.NewHashFromStr(o.Hash)
 			point := wire.OutPoint{Hash: *utxoHash, Index: o.Index}
 			tx.AddTxIn(wire.NewTxIn(&point, nil, nil))
+			scripts = append(scripts, o.Script)
 
 			input := TxInput{Hash: o.Hash, Index: o.Index, Address: o.Address}
 			inputs = append(inputs, input)
-			//add missing sender utxo
-			if o.Value <= 546 {
-				totalBalance += o.Value
-			}
 		}
 	}
 	if sender != "" {
 		utxos = utxos[:i]
 	}
 
-	minAmount := minOutputAmount(feePerKb)
-	feeAmount := txFee(feePerKb, uint32(tx.SerializeSize())+TX_OUTPUT_SIZE)
+	if selector == nil {
+		selector = firstFitSelector{}
+	}
 
-	// TODO: use up all UTXOs for all used addresses to avoid leaving funds in addresses whose public key is revealed
-	// TODO: avoid combining addresses in a single transaction when possible to reduce information leakage
-	// TODO: use up UTXOs received from any of the output scripts that this transaction sends funds to, to mitigate an
-	//       attacker double spending and requesting a refund
-	for i := 0; i < len(utxos); i++ {
+	candidates := make([]Utxo, 0, len(utxos))
+	for _, o := range utxos {
 		//jump the utxo used before
-		if utxos[i] == usedUtxo {
+		if len(inputs) > 0 && o.Hash == usedUtxo.Hash && o.Index == usedUtxo.Index {
 			continue
 		}
+		candidates = append(candidates, o)
+	}
 
-		utxoHash, _ := chainhash.NewHashFromStr(utxos[i].Hash)
-		point := wire.OutPoint{Hash: *utxoHash, Index: utxos[i].Index}
-		tx.AddTxIn(wire.NewTxIn(&point, nil, nil))
-
-		if tx.SerializeSize()+TX_OUTPUT_SIZE > TX_MAX_SIZE { // transaction size-in-bytes too large
-			tx = nil
-			break
-		}
-
-		balance += utxos[i].Value
-
-		//  size of unconfirmed, non-change inputs for child-pays-for-parent fee
-		//  don't include parent tx with more than 10 inputs or 10 outputs
-		//  if (tx->blockHeight == TX_UNCONFIRMED && tx->inCount <= 10 && tx->outCount <= 10 &&
-		//  ! _BRWalletTxIsSend(wallet, tx)) cpfpSize += transactionVSize(tx);
-
-		// fee amount after adding a change output
-		feeAmount = txFee(feePerKb, uint32(tx.SerializeSize()+TX_OUTPUT_SIZE+cpfpSize))
+	minAmount := minOutputAmount(feePerKb)
+	baseFee := txFee(feePerKb, estimateVSize(tx, scripts))
+	params := &SelectionParams{
+		Target:     amount + baseFee - balance,
+		ChangeCost: txFee(feePerKb, estimateVSize(tx, scripts, changeScript)) - baseFee,
+		MinChange:  minAmount,
+		FeePerKb:   feePerKb,
+	}
+	// TODO: use up UTXOs received from any of the output scripts that this transaction sends funds to, to mitigate an
+	//       attacker double spending and requesting a refund
+	selected, err := selector.Select(candidates, params)
+	if err != nil {
+		log.Println("coin selection err:", err)
+		return nil, false
+	}
 
-		// increase fee to round off remaining wallet balance to nearest 100 satoshi
-		if totalBalance > amount+feeAmount {
-			feeAmount += (totalBalance - (amount + feeAmount)) % 100
-		}
+	for _, o := range selected {
+		utxoHash, _ := chainhash.NewHashFromStr(o.Hash)
+		point := wire.OutPoint{Hash: *utxoHash, Index: o.Index}
+		tx.AddTxIn(wire.NewTxIn(&point, nil, nil))
+		scripts = append(scripts, o.Script)
+		balance += o.Value
+	}
 
-		if balance == amount+feeAmount || balance >= amount+feeAmount+minAmount {
-			break
-		}
+	vsize := estimateVSize(tx, scripts, changeScript)
+	if vsize > TX_MAX_SIZE { // transaction size-in-bytes too large
+		log.Println("tx too large:", vsize)
+		return nil, false
 	}
+	// fee amount after adding a change output
+	feeAmount := txFee(feePerKb, vsize)
 
 	if (tx != nil) && (len(outputs) < 1 || balance < amount+feeAmount) { // no outputs/insufficient funds
+		// without a change output the tx is smaller and may be affordable
+		if tx != nil && len(outputs) > 0 && balance >= amount+txFee(feePerKb, estimateVSize(tx, scripts)) {
+			return tx, false
+		}
 		log.Println("no outputs/insufficient funds")
 		return nil, false
 	} else if (tx != nil) && balance-(amount+feeAmount) >= minAmount { // add change output
@@ -384,9 +745,14 @@ func CreateTxForOutputs(feePerKb uint32, sender string, outputs []TxOut, changeA
 			if strings.HasPrefix(strings.ToLower(param.Name), "bch") {
 				changeAddress, _ = util.ConvertCashAddrToLegacy(changeAddress, param)
 			}
+			script, _ := getScriptFromAddress(changeAddress, param)
+			if len(script) != len(changeScript) {
+				// pay the fee for the real change script
+				feeAmount = txFee(feePerKb, estimateVSize(tx, scripts, script))
+			}
+			changeScript = script
 		}
-		script, _ := getScriptFromAddress(changeAddress, param)
-		tx.AddTxOut(wire.NewTxOut(balance-(amount+feeAmount), script))
+		tx.AddTxOut(wire.NewTxOut(balance-(amount+feeAmount), changeScript))
 		return tx, true
 	}
 
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/btcsuite/btcd/chaincfg"
+	"testing"
+
+	badger "github.com/dgraph-io/badger"
+)
+
+func TestUtxoRecord(t *testing.T) {
+	script := []byte{0x76, 0xa9, 0x14, 0x01, 0x02, 0x03, 0x88, 0xac}
+	cases := []struct {
+		name string
+		utxo Utxo
+	}{
+		{"confirmed", Utxo{Index: 1, Address: "1b1itzeSKYEKhdcthUSnNJ47Fx2U8Zwwn", Value: 12345, Height: 650000, Script: script, Path: "0/7"}},
+		{"unconfirmed", Utxo{Index: 0, Address: "a", Value: 546, Script: script, Path: "1/0"}},
+		{"frozen", Utxo{Index: 3, Address: "b", Value: 300, Height: 1, Script: script, Frozen: true}},
+		{"no script and path", Utxo{Index: 2, Address: "c", Value: 1}},
+		{"large values", Utxo{Index: 0xffffffff, Address: "d", Value: 21e14, Height: 1 << 40, Script: script}},
+	}
+
+	for i, c := range cases {
+		u := c.utxo
+		u.Hash = fmt.Sprintf("%064x", i+1)
+		got, err := decodeUtxo(encodeUtxo(&u))
+		if err != nil {
+			t.Fatal(c.name, err)
+		}
+		if got.Hash != u.Hash || got.Index != u.Index || got.Address != u.Address || got.Value != u.Value ||
+			got.Height != u.Height || !bytes.Equal(got.Script, u.Script) || got.Path != u.Path || got.Frozen != u.Frozen {
+			t.Fatalf("%s: decoded %+v, want %+v", c.name, got, u)
+		}
+	}
+}
+
+func TestUtxoRecordInvalid(t *testing.T) {
+	u := Utxo{Hash: fmt.Sprintf("%064x", 1), Index: 1, Address: "a", Value: 1000, Script: []byte{0x51}, Path: "0/1"}
+	valid := encodeUtxo(&u)
+	wrongVersion := append([]byte(nil), valid...)
+	wrongVersion[0]++
+
+	cases := []struct {
+		name string
+		v    []byte
+	}{
+		{"empty", nil},
+		{"legacy", []byte("1b1itzeSKYEKhdcthUSnNJ47Fx2U8Zwwn:1000")},
+		{"wrong version", wrongVersion},
+		{"truncated", valid[:len(valid)-2]},
+	}
+	for _, c := range cases {
+		if _, err := decodeUtxo(c.v); err == nil {
+			t.Fatal(c.name, "record decoded")
+		}
+	}
+}
+
+func TestMigrateUtxoDb(t *testing.T) {
+	if err := openDb(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer closeDb()
+
+	addr := "1b1itzeSKYEKhdcthUSnNJ47Fx2U8Zwwn"
+	hash := fmt.Sprintf("%064x", 1)
+	legacy := map[string]string{
+		hash + "/0": addr + ":1000",
+		hash + "/5": addr + ":25000",
+		// no value, left alone
+		hash + "/6": addr,
+		// not a legacy utxo key
+		"meta/other": addr + ":1",
+	}
+	err := db.Update(func(txn *badger.Txn) error {
+		for k, v := range legacy {
+			if err := txn.Set([]byte(k), []byte(v)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	param := &chaincfg.MainNetParams
+	script, err := scriptForAddress(addr, param)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the second run finds the version key and does nothing
+	for i := 0; i < 2; i++ {
+		if err = migrateUtxoDb(param); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		index uint32
+		value int64
+	}{
+		{0, 1000},
+		{5, 25000},
+	}
+	err = db.View(func(txn *badger.Txn) error {
+		for _, c := range cases {
+			u, err := getUtxo(txn, hash, c.index)
+			if err != nil {
+				return fmt.Errorf("utxo %d: %v", c.index, err)
+			}
+			if u.Address != addr || u.Value != c.value || u.Height != 0 || !bytes.Equal(u.Script, script) {
+				return fmt.Errorf("utxo %d migrated as %+v", c.index, u)
+			}
+			if _, err = txn.Get(append(addrKeyPrefix(addr), outpointKey(hash, c.index)...)); err != nil {
+				return fmt.Errorf("address index of utxo %d: %v", c.index, err)
+			}
+			if _, err = txn.Get([]byte(outpointKey(hash, c.index))); err != badger.ErrKeyNotFound {
+				return fmt.Errorf("legacy record of utxo %d kept", c.index)
+			}
+		}
+		for _, k := range []string{hash + "/6", "meta/other", UTXO_VERSION_KEY} {
+			if _, err := txn.Get([]byte(k)); err != nil {
+				return fmt.Errorf("%s: %v", k, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
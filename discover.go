@@ -0,0 +1,291 @@
+package main
+
+import (
+	"fmt"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/rpcclient"
+	conf "github.com/bytefly/dashcash-wallet/config"
+	"github.com/bytefly/dashcash-wallet/util"
+	"log"
+	"time"
+
+	badger "github.com/dgraph-io/badger"
+)
+
+// BranchDiscovery is the counter of a branch before and after a discovery.
+type BranchDiscovery struct {
+	Branch uint32
+	Before uint32
+	After  uint32
+}
+
+type DiscoveryReport struct {
+	Time int64
+	// "scantxoutset", or "rescan" from the height From
+	Method   string
+	From     int64
+	Gap      uint32
+	Derived  int
+	Branches []BranchDiscovery
+	// unspent outputs of the discovered addresses missing from the db
+	Utxos []Utxo
+}
+
+// gapWindow holds the addresses derived past the last used index of each
+// branch, up to the gap limit.
+type gapWindow struct {
+	xpub  string
+	param *chaincfg.Params
+	gap   uint32
+	// first index not derived yet, by branch
+	next [2]uint32
+	// last used index + 1, by branch
+	used  [2]uint32
+	addrs map[string]util.AddrPath
+	// derived since the last call to take
+	fresh []string
+}
+
+func newGapWindow(config *conf.Config, gap uint32) *gapWindow {
+	w := &gapWindow{
+		xpub:  config.Xpub,
+		param: util.GetParamByName(config.ChainName),
+		gap:   gap,
+		addrs: make(map[string]util.AddrPath),
+	}
+	w.next[util.BRANCH_EXTERNAL] = config.Index
+	w.used[util.BRANCH_EXTERNAL] = config.Index
+	w.next[util.BRANCH_INTERNAL] = config.InIndex
+	w.used[util.BRANCH_INTERNAL] = config.InIndex
+	return w
+}
+
+// extend derives the addresses up to the gap past the last used ones.
+func (w *gapWindow) extend() error {
+	for branch := range w.next {
+		for ; w.next[branch] < w.used[branch]+w.gap; w.next[branch]++ {
+			path := util.AddrPath{Branch: uint32(branch), Index: w.next[branch]}
+			addr, err := util.DeriveAddress(w.xpub, path, w.param)
+			if err != nil {
+				return err
+			}
+			w.addrs[addr] = path
+			w.fresh = append(w.fresh, addr)
+		}
+	}
+	return nil
+}
+
+// mark records the address as used, telling whether it moved the window.
+func (w *gapWindow) mark(addr string) bool {
+	path, ok := w.addrs[addr]
+	if !ok || path.Index < w.used[path.Branch] {
+		return false
+	}
+	w.used[path.Branch] = path.Index + 1
+	return true
+}
+
+// take returns the addresses derived since the last call.
+func (w *gapWindow) take() []string {
+	fresh := w.fresh
+	w.fresh = nil
+	return fresh
+}
+
+// discoverByScan looks the window up with scantxoutset until a whole gap of
+// addresses holds nothing. It only sees the addresses with unspent outputs.
+func discoverByScan(client *rpcclient.Client, config *conf.Config, w *gapWindow) ([]Utxo, error) {
+	found := make([]Utxo, 0)
+	for {
+		if err := w.extend(); err != nil {
+			return nil, err
+		}
+		addrs := w.take()
+		if len(addrs) == 0 {
+			return found, nil
+		}
+		utxos, err := scanTxOutSet(client, config, addrs)
+		if err != nil {
+			return nil, err
+		}
+		for _, u := range utxos {
+			w.mark(u.Address)
+		}
+		found = append(found, utxos...)
+	}
+}
+
+// discoverByRescan looks for outputs paying the window in the blocks from
+// the height on, so spent addresses count as used too.
+func discoverByRescan(client *rpcclient.Client, config *conf.Config, w *gapWindow, from int64) ([]Utxo, error) {
+	if err := w.extend(); err != nil {
+		return nil, err
+	}
+	var extendErr error
+	utxos, err := scanBlocks(client, from, func(script []byte) (string, bool) {
+		addr, ok := scriptAddress(config.ChainName, script)
+		if !ok {
+			return "", false
+		}
+		if _, ok = w.addrs[addr]; !ok {
+			return "", false
+		}
+		if w.mark(addr) && extendErr == nil {
+			extendErr = w.extend()
+		}
+		return addr, true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return utxos, extendErr
+}
+
+// discoverAddresses derives gap addresses past the counters of both branches
+// and looks for their history on the chain, by scantxoutset or by a rescan
+// from the height from when it is above 0. The registry and counters are
+// extended up to the last used address, and the txs paying the unspent
+// outputs found are parsed into the db and the pool, so they are notified.
+func discoverAddresses(config *conf.Config, gap uint32, from int64) (*DiscoveryReport, error) {
+	client, err := ConnectRPC(config)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Shutdown()
+
+	m.Lock()
+	w := newGapWindow(config, gap)
+	m.Unlock()
+
+	report := &DiscoveryReport{Time: time.Now().Unix(), Method: "scantxoutset", Gap: gap}
+	var utxos []Utxo
+	if from > 0 {
+		report.Method = "rescan"
+		report.From = from
+		utxos, err = discoverByRescan(client, config, w, from)
+	} else {
+		utxos, err = discoverByScan(client, config, w)
+	}
+	if err != nil {
+		return nil, err
+	}
+	report.Derived = len(w.addrs)
+
+	m.Lock()
+	defer m.Unlock()
+
+	param := util.GetParamByName(config.ChainName)
+	for _, branch := range []uint32{util.BRANCH_EXTERNAL, util.BRANCH_INTERNAL} {
+		b := BranchDiscovery{Branch: branch, Before: config.Index, After: w.used[branch]}
+		if branch == util.BRANCH_INTERNAL {
+			b.Before = config.InIndex
+		}
+		if b.After > b.Before {
+			n, err := fillAddressRegistry(config, param, branch, b.After)
+			if err != nil {
+				return nil, err
+			}
+			syncAddressIndex(config, branch, b.After)
+			log.Println("discover: register", n, "addresses of branch", branch, "up to index", b.After)
+		} else {
+			b.After = b.Before
+		}
+		report.Branches = append(report.Branches, b)
+	}
+
+	report.Utxos = make([]Utxo, 0)
+	found := make(map[string]bool)
+	heights := make(map[uint64]map[string]bool)
+	for _, u := range utxos {
+		stored := false
+		db.View(func(txn *badger.Txn) error {
+			_, err := getUtxo(txn, u.Hash, u.Index)
+			stored = err == nil
+			return nil
+		})
+		if stored {
+			continue
+		}
+		found[outpointKey(u.Hash, u.Index)] = true
+		if heights[u.Height] == nil {
+			heights[u.Height] = make(map[string]bool)
+		}
+		heights[u.Height][u.Hash] = true
+		log.Println("discover: add utxo", u.Hash, u.Index, u.Address, u.Value)
+		report.Utxos = append(report.Utxos, u)
+	}
+
+	for height, hashes := range heights {
+		if err = parseDiscoveredTxs(client, config, height, hashes, found); err != nil {
+			log.Println("parse discovered txs err:", err, height)
+		}
+	}
+	return report, nil
+}
+
+// parseDiscoveredTxs applies the txs of the block paying the discovered
+// utxos like the block parser does, and pools their messages so deposits
+// are notified once confirmed. Their outputs spent since are dropped again.
+// The caller holds m.
+func parseDiscoveredTxs(client *rpcclient.Client, config *conf.Config, height uint64, hashes, found map[string]bool) error {
+	blockHash, err := client.GetBlockHash(int64(height))
+	if err != nil {
+		return fmt.Errorf("read block hash err: %v", err)
+	}
+	block, err := client.GetBlock(blockHash)
+	if err != nil {
+		return fmt.Errorf("get block err: %v", err)
+	}
+
+	// keep the undo record of a block we hold in line, so a reorg reverts them
+	undo, err := getBlockUndo(height)
+	stored := err == nil && undo.Hash == blockHash.String()
+	if !stored {
+		undo = &BlockUndo{Hash: blockHash.String(), Height: height}
+	}
+	if undo.Spenders == nil {
+		undo.Spenders = make(map[string]string)
+	}
+
+	prevouts := newPrevoutCache(client, block, nil)
+	messages := make([]NotifyMessage, 0)
+	for _, tx := range block.Transactions {
+		hash := tx.TxHash().String()
+		if !hashes[hash] {
+			continue
+		}
+		txMessages, err := ParseTransaction(prevouts, tx, config.ChainName, uint64(block.Header.Timestamp.Unix()), undo)
+		if err != nil {
+			return err
+		}
+		for i := range tx.TxOut {
+			if !found[outpointKey(hash, uint32(i))] {
+				removeUtxo(hash, uint32(i))
+			}
+		}
+		messages = append(messages, txMessages...)
+	}
+	if len(messages) == 0 {
+		return nil
+	}
+
+	if stored {
+		undo.Messages = append(undo.Messages, messages...)
+		if err = saveBlockUndo(height, undo); err != nil {
+			log.Println("save block undo err:", err, height)
+		}
+	}
+	if err = addPoolMessages(height, messages); err != nil {
+		return fmt.Errorf("save pool err: %v", err)
+	}
+	log.Println("discover: add txs to", height, "txs size:", len(messages))
+	return nil
+}
+
+func printDiscoveryReport(report *DiscoveryReport) {
+	log.Println("discover by", report.Method, "gap:", report.Gap, "derived:", report.Derived, "new utxos:", len(report.Utxos))
+	for _, b := range report.Branches {
+		log.Println("branch", b.Branch, "index:", b.Before, "->", b.After)
+	}
+}
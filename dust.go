@@ -0,0 +1,225 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	conf "github.com/bytefly/dashcash-wallet/config"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	badger "github.com/dgraph-io/badger"
+)
+
+const (
+	// bitcoind default -dustrelayfee, satoshis per kB
+	DUST_RELAY_FEE_PER_KB = 3000
+	// estimated size for an input spending a witness v0 output, in vbytes
+	TX_WITNESS_INPUT_SIZE = 67
+
+	// abandoned/<hash>/<index> keeps abandoned dust out of the utxo set
+	ABANDONED_KEY_PREFIX = "abandoned/"
+)
+
+var dustRelayFee int64 = DUST_RELAY_FEE_PER_KB
+
+func setDustRelayFee(feePerKb uint32) {
+	if feePerKb > 0 {
+		dustRelayFee = int64(feePerKb)
+	}
+}
+
+// dustThreshold returns the value up to which an output with the script is
+// dust, the fee of creating and spending it at the dust relay fee. Unlike
+// bitcoind the threshold itself is dust, as with the old 546 cutoff, so the
+// Omni reference outputs are caught.
+func dustThreshold(script []byte) int64 {
+	size := int64(TX_OUTPUT_SIZE)
+	if len(script) > 0 {
+		size = int64(wire.NewTxOut(0, script).SerializeSize())
+	}
+	if txscript.IsWitnessProgram(script) {
+		size += TX_WITNESS_INPUT_SIZE
+	} else {
+		size += TX_INPUT_SIZE
+	}
+	return dustRelayFee * size / 1000
+}
+
+func isDust(u *Utxo) bool {
+	return u.Value <= dustThreshold(u.Script)
+}
+
+func abandonedKey(hash string, index uint32) []byte {
+	return []byte(ABANDONED_KEY_PREFIX + outpointKey(hash, index))
+}
+
+func isAbandoned(txn *badger.Txn, hash string, index uint32) bool {
+	_, err := txn.Get(abandonedKey(hash, index))
+	return err == nil
+}
+
+// freezeDust applies the current dust policy to the stored utxos, freezing
+// the dust and releasing what is no longer dust.
+func freezeDust() error {
+	changed := make([]Utxo, 0)
+	err := iterateUtxo([]byte(UTXO_KEY_PREFIX), func(u *Utxo) {
+		if u.Frozen != isDust(u) {
+			u.Frozen = !u.Frozen
+			changed = append(changed, *u)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	// keep the transactions small on a large utxo set
+	for len(changed) > 0 {
+		n := 1000
+		if n > len(changed) {
+			n = len(changed)
+		}
+		err = db.Update(func(txn *badger.Txn) error {
+			for i := range changed[:n] {
+				if err := putUtxo(txn, &changed[i]); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		changed = changed[n:]
+	}
+	return nil
+}
+
+// dustUtxos returns the dust at the outpoints, all of it when none is
+// given. Dust frozen by an operator is left alone.
+func dustUtxos(outpoints []string) ([]Utxo, error) {
+	if len(outpoints) == 0 {
+		frozen, err := frozenOutpoints()
+		if err != nil {
+			return nil, err
+		}
+		utxos := make([]Utxo, 0)
+		err = iterateUtxo([]byte(UTXO_KEY_PREFIX), func(u *Utxo) {
+			if u.Frozen && !frozen[outpointKey(u.Hash, u.Index)] {
+				utxos = append(utxos, *u)
+			}
+		})
+		return utxos, err
+	}
+
+	utxos := make([]Utxo, 0, len(outpoints))
+	err := db.View(func(txn *badger.Txn) error {
+		for _, str := range outpoints {
+			hash, index, err := parseOutpoint(str)
+			if err != nil {
+				return err
+			}
+			u, err := getUtxo(txn, hash, index)
+			if err == badger.ErrKeyNotFound {
+				return fmt.Errorf("utxo %s not found", str)
+			} else if err != nil {
+				return err
+			}
+			if !u.Frozen {
+				return fmt.Errorf("utxo %s is not dust", str)
+			}
+			if isFrozen(txn, hash, index) {
+				return fmt.Errorf("utxo %s is frozen", str)
+			}
+			utxos = append(utxos, *u)
+		}
+		return nil
+	})
+	return utxos, err
+}
+
+// spendDust merges the dust into an inner address, adding the smallest inner
+// utxo able to pay the fee when the dust cannot. The caller holds m.
+func spendDust(config *conf.Config, dust []Utxo, feeRate uint32) (*SentTx, error) {
+	dust, err := filterReserved(dust)
+	if err != nil {
+		return nil, err
+	}
+	if len(dust) == 0 {
+		return nil, errors.New("no dust to spend")
+	}
+	changeAddress, changeScript, err := innerChangeScript(config)
+	if err != nil {
+		return nil, err
+	}
+
+	inputs := dust
+	tx, err := buildMergeTx(inputs, changeScript, feeRate)
+	if err != nil {
+		utxos, err := GetAllUtxoByBranch(1, false)
+		if err != nil {
+			return nil, err
+		}
+		funds, err := filterReserved(utxos)
+		if err != nil {
+			return nil, err
+		}
+		sort.SliceStable(funds, func(i, j int) bool {
+			return funds[i].Value < funds[j].Value
+		})
+		for _, u := range funds {
+			if u.Height == 0 {
+				continue
+			}
+			inputs = append(dust[:len(dust):len(dust)], u)
+			if tx, err = buildMergeTx(inputs, changeScript, feeRate); err == nil {
+				break
+			}
+		}
+		if tx == nil {
+			return nil, errors.New("no inner utxo can pay the fee of the dust")
+		}
+	}
+
+	signedTx, err := signMsgTx(config.ChainName, config.Xpriv, tx, GetUtxoByKey, true)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := broadcastTx(config, signedTx, feeRate)
+	if err != nil {
+		return nil, fmt.Errorf("send tx err:%v", err)
+	}
+	useChangeAddress(config, changeAddress)
+	s, err := getSentTx(hash)
+	if err != nil {
+		s = newSentTx(signedTx, inputs, feeRate)
+	}
+	// dust of the deposit addresses is collected like a sweep
+	s.Sweep = true
+	if err = saveSentTx(s); err != nil {
+		log.Println("save sent tx err:", err, hash)
+	}
+	log.Println("spend", len(dust), "dust utxos by", hash, "fee:", s.Fee)
+	return s, nil
+}
+
+// abandonDust drops the dust from the utxo set for good.
+func abandonDust(dust []Utxo) error {
+	return db.Update(func(txn *badger.Txn) error {
+		now := strconv.FormatInt(time.Now().Unix(), 10)
+		for i := range dust {
+			u := &dust[i]
+			log.Println("abandon dust:", u.Hash, u.Index, u.Address, u.Value)
+			if err := deleteUtxo(txn, u); err != nil {
+				return err
+			}
+			if err := txn.Set(abandonedKey(u.Hash, u.Index), []byte(now)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDustThreshold(t *testing.T) {
+	p2pkh := testScript([]byte{0x76, 0xa9, 0x14}, 20, 0x88, 0xac)
+	p2wpkh := testScript([]byte{0x00, 0x14}, 20)
+	p2sh := testScript([]byte{0xa9, 0x14}, 20, 0x87)
+
+	cases := []struct {
+		name      string
+		relayFee  uint32
+		script    []byte
+		threshold int64
+	}{
+		{"p2pkh", 0, p2pkh, 546},
+		{"p2wpkh", 0, p2wpkh, 294},
+		{"p2sh", 0, p2sh, 540},
+		{"no script as p2pkh", 0, nil, 546},
+		{"p2pkh at 1000/kB", 1000, p2pkh, 182},
+		{"p2wpkh at 1000/kB", 1000, p2wpkh, 98},
+	}
+
+	defer setDustRelayFee(DUST_RELAY_FEE_PER_KB)
+	for _, c := range cases {
+		dustRelayFee = DUST_RELAY_FEE_PER_KB
+		setDustRelayFee(c.relayFee)
+		if threshold := dustThreshold(c.script); threshold != c.threshold {
+			t.Fatalf("%s: threshold %d, want %d", c.name, threshold, c.threshold)
+		}
+		// the threshold itself is dust
+		u := Utxo{Value: c.threshold, Script: c.script}
+		if !isDust(&u) {
+			t.Fatalf("%s: %d not dust", c.name, u.Value)
+		}
+		u.Value++
+		if isDust(&u) {
+			t.Fatalf("%s: %d dust", c.name, u.Value)
+		}
+	}
+}
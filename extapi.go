@@ -7,7 +7,7 @@ import (
 	"log"
 )
 
-func storeTokenDepositTx(config *conf.Config, token string, hash string, addr string, amount string) {
+func storeTokenDepositTx(config *conf.Config, token string, hash string, addr string, amount string) error {
 	comm := tars.NewCommunicator()
 	obj := "NeexTrx.FreezingSysServer.FreezingSysObj"
 	registry := config.RegistryAddr
@@ -19,12 +19,13 @@ func storeTokenDepositTx(config *conf.Config, token string, hash string, addr st
 	ret, err := app.User_into_dc2(addr, token, hash, amount, config.ChainId)
 	if err != nil {
 		log.Println("call freezing deposit err:", err)
-		return
+		return err
 	}
 	log.Println("call freezing deposit result:", ret)
+	return nil
 }
 
-func storeTokenWithdrawTx(config *conf.Config, token string, hash string, addr string, amount string, fee string) {
+func storeTokenWithdrawTx(config *conf.Config, token string, hash string, addr string, amount string, fee string) error {
 	comm := tars.NewCommunicator()
 	obj := "NeexTrx.FreezingSysServer.FreezingSysObj"
 	registry := config.RegistryAddr
@@ -37,7 +38,8 @@ func storeTokenWithdrawTx(config *conf.Config, token string, hash string, addr s
 	ret, err := app.Commit_withdraw_dc(hash, token, amount, fee, &rsp)
 	if err != nil {
 		log.Println("call freezing withdraw err:", err)
-		return
+		return err
 	}
 	log.Println("call freezing withdraw result:", ret, ", rsp:", rsp, ", hash:", hash)
+	return nil
 }
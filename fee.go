@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/wire"
+	conf "github.com/bytefly/dashcash-wallet/config"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	FEE_TARGET_FAST    = "fast"
+	FEE_TARGET_NORMAL  = "normal"
+	FEE_TARGET_ECONOMY = "economy"
+
+	// how long an estimation from the node is reused
+	FEE_CACHE_SECONDS = 60
+)
+
+type feeEstimate struct {
+	rate    uint32
+	updated time.Time
+}
+
+var (
+	feeCache = make(map[string]feeEstimate)
+	feeLock  sync.Mutex
+)
+
+type smartFeeResult struct {
+	FeeRate *float64 `json:"feerate"`
+	Errors  []string `json:"errors"`
+	Blocks  int64    `json:"blocks"`
+}
+
+// feeTargetBlocks maps a fee target to its confirmation target and estimate mode.
+func feeTargetBlocks(config *conf.Config, target string) (int64, string, error) {
+	switch target {
+	case FEE_TARGET_FAST:
+		return int64(config.FeeTargetFast), "CONSERVATIVE", nil
+	case FEE_TARGET_NORMAL, "":
+		return int64(config.FeeTargetNormal), "CONSERVATIVE", nil
+	case FEE_TARGET_ECONOMY:
+		return int64(config.FeeTargetEconomy), "ECONOMICAL", nil
+	}
+	return 0, "", fmt.Errorf("unknown fee target: %s", target)
+}
+
+// clampFeeRate keeps a fee rate (satoshis per kB) within the configured bounds.
+func clampFeeRate(config *conf.Config, rate uint32) uint32 {
+	if config.MinFeeRate > 0 && rate < config.MinFeeRate {
+		rate = config.MinFeeRate
+	}
+	if config.MaxFeeRate > 0 && rate > config.MaxFeeRate {
+		rate = config.MaxFeeRate
+	}
+	if rate < MIN_FEE_PER_KB {
+		rate = MIN_FEE_PER_KB
+	}
+	return rate
+}
+
+// estimateSmartFee asks the node for a fee rate in satoshis per kB.
+func estimateSmartFee(config *conf.Config, blocks int64, mode string) (uint32, error) {
+	client, err := ConnectRPC(config)
+	if err != nil {
+		return 0, err
+	}
+	defer client.Shutdown()
+
+	params := make([]json.RawMessage, 2)
+	params[0], _ = json.Marshal(blocks)
+	params[1], _ = json.Marshal(mode)
+	raw, err := client.RawRequest("estimatesmartfee", params)
+	if err != nil {
+		return 0, err
+	}
+
+	var result smartFeeResult
+	if err = json.Unmarshal(raw, &result); err != nil {
+		return 0, err
+	}
+	if result.FeeRate == nil || *result.FeeRate <= 0 {
+		return 0, fmt.Errorf("no fee estimation: %v", result.Errors)
+	}
+	return uint32(*result.FeeRate*1e8 + 0.5), nil
+}
+
+// EstimateFeeRate returns the fee rate for the target in satoshis per kB,
+// falling back to the static rate of the config when the node cannot tell.
+func EstimateFeeRate(config *conf.Config, target string) (uint32, error) {
+	blocks, mode, err := feeTargetBlocks(config, target)
+	if err != nil {
+		return 0, err
+	}
+
+	rate, err := nodeFeeRate(config, target, blocks, mode)
+	if err != nil {
+		log.Println("estimate fee err:", err, ", use static fee rate:", config.FeeRate)
+		return clampFeeRate(config, config.FeeRate), nil
+	}
+	return rate, nil
+}
+
+// NodeFeeRate returns the fee rate for the target estimated by the node,
+// an error when the node cannot tell.
+func NodeFeeRate(config *conf.Config, target string) (uint32, error) {
+	blocks, mode, err := feeTargetBlocks(config, target)
+	if err != nil {
+		return 0, err
+	}
+	return nodeFeeRate(config, target, blocks, mode)
+}
+
+func nodeFeeRate(config *conf.Config, target string, blocks int64, mode string) (uint32, error) {
+	feeLock.Lock()
+	defer feeLock.Unlock()
+
+	cached, ok := feeCache[target]
+	if ok && time.Since(cached.updated) < FEE_CACHE_SECONDS*time.Second {
+		return cached.rate, nil
+	}
+
+	rate, err := estimateSmartFee(config, blocks, mode)
+	if err != nil {
+		return 0, err
+	}
+
+	rate = clampFeeRate(config, rate)
+	feeCache[target] = feeEstimate{rate, time.Now()}
+	return rate, nil
+}
+
+// feeRateFromRequest reads the feeRate (satoshis per kB) or feeTarget
+// parameter of a parsed request.
+func feeRateFromRequest(config *conf.Config, r *http.Request) (uint32, error) {
+	if str := r.Form.Get("feeRate"); str != "" {
+		rate, err := strconv.ParseUint(str, 10, 32)
+		if err != nil || rate == 0 {
+			return 0, errors.New("invalid fee rate")
+		}
+		return clampFeeRate(config, uint32(rate)), nil
+	}
+
+	return EstimateFeeRate(config, r.Form.Get("feeTarget"))
+}
+
+// txFeePaid returns the inputs minus the outputs of an unsigned wallet tx.
+func txFeePaid(tx *wire.MsgTx) int64 {
+	var fee int64
+	for _, in := range tx.TxIn {
+		out, err := GetUtxoByKey(in.PreviousOutPoint.Hash.String(), in.PreviousOutPoint.Index)
+		if err == nil {
+			fee += out.Amount
+		}
+	}
+	for _, out := range tx.TxOut {
+		fee -= out.Value
+	}
+	return fee
+}
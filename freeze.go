@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	badger "github.com/dgraph-io/badger"
+)
+
+const (
+	FREEZE_KEY_PREFIX = "freeze/"
+	// freezelog/<seq> holds the audit trail of freezes and unfreezes
+	FREEZE_LOG_KEY_PREFIX = "freezelog/"
+	FREEZE_LOG_SEQ_KEY    = "meta/freezeLogSeq"
+
+	FREEZE_ACTION   = "freeze"
+	UNFREEZE_ACTION = "unfreeze"
+)
+
+// Freeze keeps an outpoint from being spent or counted in the balance until
+// an operator unfreezes it. The outpoint need not be in the utxo set yet.
+type Freeze struct {
+	Hash     string
+	Index    uint32
+	Reason   string
+	Operator string
+	Created  int64
+}
+
+// FreezeEvent is an entry of the audit trail.
+type FreezeEvent struct {
+	Hash     string
+	Index    uint32
+	Action   string
+	Reason   string
+	Operator string
+	Time     int64
+}
+
+func freezeKey(hash string, index uint32) []byte {
+	return []byte(FREEZE_KEY_PREFIX + outpointKey(hash, index))
+}
+
+func logFreezeEvent(txn *badger.Txn, e *FreezeEvent) error {
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	seq, err := nextSequence(txn, FREEZE_LOG_SEQ_KEY)
+	if err != nil {
+		return err
+	}
+	return txn.Set(heightKey(FREEZE_LOG_KEY_PREFIX, seq), buf)
+}
+
+// freezeOutpoints freezes all the outpoints or none of them.
+func freezeOutpoints(outpoints []string, reason, operator string) ([]Freeze, error) {
+	if reason == "" || operator == "" {
+		return nil, errors.New("reason and operator are required")
+	}
+
+	now := time.Now().Unix()
+	freezes := make([]Freeze, 0, len(outpoints))
+	err := db.Update(func(txn *badger.Txn) error {
+		for _, str := range outpoints {
+			hash, index, err := parseOutpoint(str)
+			if err != nil {
+				return err
+			}
+			if _, err = txn.Get(freezeKey(hash, index)); err == nil {
+				return fmt.Errorf("utxo %s is already frozen", str)
+			}
+
+			f := Freeze{Hash: hash, Index: index, Reason: reason, Operator: operator, Created: now}
+			buf, err := json.Marshal(&f)
+			if err != nil {
+				return err
+			}
+			if err = txn.Set(freezeKey(hash, index), buf); err != nil {
+				return err
+			}
+			err = logFreezeEvent(txn, &FreezeEvent{Hash: hash, Index: index, Action: FREEZE_ACTION, Reason: reason, Operator: operator, Time: now})
+			if err != nil {
+				return err
+			}
+			freezes = append(freezes, f)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range freezes {
+		log.Println("freeze utxo:", f.Hash, f.Index, "by", operator, "for", reason)
+	}
+	return freezes, nil
+}
+
+// unfreezeOutpoints unfreezes all the outpoints or none of them.
+func unfreezeOutpoints(outpoints []string, reason, operator string) error {
+	if reason == "" || operator == "" {
+		return errors.New("reason and operator are required")
+	}
+
+	now := time.Now().Unix()
+	err := db.Update(func(txn *badger.Txn) error {
+		for _, str := range outpoints {
+			hash, index, err := parseOutpoint(str)
+			if err != nil {
+				return err
+			}
+			if _, err = txn.Get(freezeKey(hash, index)); err != nil {
+				return fmt.Errorf("utxo %s is not frozen", str)
+			}
+
+			if err = txn.Delete(freezeKey(hash, index)); err != nil {
+				return err
+			}
+			err = logFreezeEvent(txn, &FreezeEvent{Hash: hash, Index: index, Action: UNFREEZE_ACTION, Reason: reason, Operator: operator, Time: now})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, str := range outpoints {
+		log.Println("unfreeze utxo:", str, "by", operator, "for", reason)
+	}
+	return nil
+}
+
+func listFreezes() ([]Freeze, error) {
+	freezes := make([]Freeze, 0)
+	err := db.View(func(txn *badger.Txn) error {
+		prefix := []byte(FREEZE_KEY_PREFIX)
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			err := it.Item().Value(func(v []byte) error {
+				var f Freeze
+				if err := json.Unmarshal(v, &f); err != nil {
+					return err
+				}
+				freezes = append(freezes, f)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return freezes, err
+}
+
+// freezeHistory returns the audit trail, oldest first, of one outpoint when
+// hash is not empty.
+func freezeHistory(hash string, index uint32) ([]FreezeEvent, error) {
+	events := make([]FreezeEvent, 0)
+	err := db.View(func(txn *badger.Txn) error {
+		prefix := []byte(FREEZE_LOG_KEY_PREFIX)
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			err := it.Item().Value(func(v []byte) error {
+				var e FreezeEvent
+				if err := json.Unmarshal(v, &e); err != nil {
+					return err
+				}
+				if hash == "" || (e.Hash == hash && e.Index == index) {
+					events = append(events, e)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return events, err
+}
+
+// frozenOutpoints returns the frozen outpoints keyed by outpointKey.
+func frozenOutpoints() (map[string]bool, error) {
+	freezes, err := listFreezes()
+	if err != nil {
+		return nil, err
+	}
+
+	frozen := make(map[string]bool)
+	for _, f := range freezes {
+		frozen[outpointKey(f.Hash, f.Index)] = true
+	}
+	return frozen, nil
+}
+
+func isFrozen(txn *badger.Txn, hash string, index uint32) bool {
+	_, err := txn.Get(freezeKey(hash, index))
+	return err == nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestFreezeHistory(t *testing.T) {
+	if err := openDb(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer closeDb()
+
+	hash := fmt.Sprintf("%064x", 1)
+	outpoints := []string{hash + ":0", hash + ":1", hash + ":2"}
+	if _, err := freezeOutpoints(outpoints, "dust attack", "ops"); err != nil {
+		t.Fatal(err)
+	}
+	if err := unfreezeOutpoints(outpoints[1:2], "checked", "ops"); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := freezeHistory("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every event of one call is kept, in order
+	cases := []struct {
+		index  uint32
+		action string
+	}{
+		{0, FREEZE_ACTION},
+		{1, FREEZE_ACTION},
+		{2, FREEZE_ACTION},
+		{1, UNFREEZE_ACTION},
+	}
+	if len(events) != len(cases) {
+		t.Fatalf("%d events, want %d", len(events), len(cases))
+	}
+	for i, c := range cases {
+		if events[i].Hash != hash || events[i].Index != c.index || events[i].Action != c.action {
+			t.Fatalf("event %d: %+v", i, events[i])
+		}
+	}
+}
@@ -53,8 +53,8 @@ func saveInnerTxFlow(config *conf.Config, message NotifyMessage, symbol, fee str
 
 	userID, err := getOpUserIDByTxHash(config, message.TxHash)
 	if err != nil {
-		//admin deposit user id is 0
-		if message.TxType != TYPE_ADMIN_DEPOSIT {
+		//admin deposit and sweeps of the wallet have user id 0
+		if message.TxType != TYPE_ADMIN_DEPOSIT && !isSweepTx(message.TxHash) {
 			return
 		}
 		userID = 0
@@ -383,6 +383,14 @@ func getCoinIDByName(config *conf.Config, coinName string) (coinID int, err erro
 }
 
 func getUserIDByAddress(config *conf.Config, address string) (userID int, err error) {
+	// addresses issued with a user id carry the binding in the registry
+	if rec, e := lookupAddress(address); e == nil && rec.UserId != "" {
+		if userID, e = strconv.Atoi(rec.UserId); e == nil {
+			return
+		}
+		log.Println("registry user id is not numeric:", rec.UserId, address)
+	}
+
 	var status int
 	connStr := fmt.Sprintf("%s:%s@tcp(%s)/%s", config.DBUser, config.DBPass, config.DBHost, config.DBName)
 	db, err := sql.Open("mysql", connStr)
@@ -9,12 +9,14 @@ import (
 	conf "github.com/bytefly/dashcash-wallet/config"
 	"github.com/bytefly/dashcash-wallet/usdt"
 	"github.com/bytefly/dashcash-wallet/util"
+	"github.com/gorilla/mux"
 	"log"
 	"math/big"
 	"net/http"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 var m sync.Mutex
@@ -92,13 +94,29 @@ func SendCoinHandler(config *conf.Config) func(w http.ResponseWriter, r *http.Re
 			return
 		}
 
+		feeRate, err := feeRateFromRequest(config, r)
+		if err != nil {
+			RespondWithError(w, 400, err.Error())
+			return
+		}
+
+		selector, err := coinSelectorFromRequest(config, "sendCoin", r)
+		if err != nil {
+			RespondWithError(w, 400, err.Error())
+			return
+		}
+
 		outputs := make([]TxOut, 1)
 		outputs[0] = TxOut{Address: to, Amount: amount}
-		tx, _ := CreateTxForOutputs(config.FeeRate, "", outputs, "", param, true, false)
+		tx, _ := CreateTxForOutputs(feeRate, "", outputs, "", param, true, false, selector)
 		if tx == nil {
 			RespondWithError(w, 500, "utxo out of balance")
 			return
 		}
+		if rbfEnabled(config) {
+			signalRBF(tx)
+		}
+		fee := txFeePaid(tx)
 
 		signedTx, err := SignMsgTx(config.ChainName, config.Xpriv, tx)
 		if err != nil {
@@ -107,17 +125,120 @@ func SendCoinHandler(config *conf.Config) func(w http.ResponseWriter, r *http.Re
 		}
 		hash := signedTx.TxHash().String()
 
-		hash, err = SendTransaction(config, signedTx)
+		hash, err = broadcastTx(config, signedTx, feeRate)
 		if err != nil {
 			log.Println("send tx err:", err)
 			RespondWithError(w, 500, fmt.Sprintf("send tx err:%v", err))
 			return
 		}
-		log.Println("new generated tx:", hash)
-		if err = ParseMempoolTransaction(config, signedTx, config.ChainName); err != nil {
-			log.Println("parse signed tx error:", err)
+		log.Println("new generated tx:", hash, "fee:", fee, "fee rate:", feeRate)
+		Respond(w, 0, map[string]string{
+			"txhash":  hash,
+			"fee":     util.LeftShift(strconv.FormatInt(fee, 10), 8),
+			"feeRate": strconv.FormatUint(uint64(feeRate), 10),
+		})
+	}
+}
+
+type SendManyOutput struct {
+	To        string `json:"to"`
+	Amount    string `json:"amount"`
+	RequestId string `json:"requestId"`
+}
+
+// SendManyHandler pays a list of withdrawal requests with a single tx.
+func SendManyHandler(config *conf.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		defer m.Unlock()
+
+		err := r.ParseForm()
+		if err != nil {
+			RespondWithError(w, 400, "Could not parse parameters")
+			return
 		}
-		Respond(w, 0, map[string]string{"txhash": hash})
+
+		var requests []SendManyOutput
+		if err = json.NewDecoder(r.Body).Decode(&requests); err != nil {
+			RespondWithError(w, 400, "invalid json body")
+			return
+		}
+		if len(requests) == 0 {
+			RespondWithError(w, 400, "Missing outputs")
+			return
+		}
+
+		batch := make([]BatchOutput, 0, len(requests))
+		seenAddr := make(map[string]bool)
+		seenId := make(map[string]bool)
+		for _, req := range requests {
+			if req.RequestId == "" || seenId[req.RequestId] {
+				RespondWithError(w, 400, fmt.Sprintf("missing or duplicated requestId: %s", req.RequestId))
+				return
+			}
+			seenId[req.RequestId] = true
+
+			if !util.VerifyAddress(config.ChainName, req.To) {
+				log.Println("Invalid to address:", req.To)
+				RespondWithError(w, 400, fmt.Sprintf("Invalid to address: %s", req.To))
+				return
+			}
+			// outputs are attributed by address when the tx is parsed
+			if seenAddr[req.To] {
+				RespondWithError(w, 400, fmt.Sprintf("duplicated to address: %s", req.To))
+				return
+			}
+			seenAddr[req.To] = true
+
+			amount, err := strconv.ParseInt(util.RightShift(req.Amount, 8), 10, 64)
+			if err != nil || amount <= 0 {
+				RespondWithError(w, 400, fmt.Sprintf("invalid amount: %s", req.Amount))
+				return
+			}
+
+			batch = append(batch, BatchOutput{RequestId: req.RequestId, Address: req.To, Amount: amount, Index: uint32(len(batch))})
+		}
+		log.Println("send coin to", len(batch), "outputs")
+
+		feeRate, err := feeRateFromRequest(config, r)
+		if err != nil {
+			RespondWithError(w, 400, err.Error())
+			return
+		}
+
+		selector, err := coinSelectorFromRequest(config, "sendMany", r)
+		if err != nil {
+			RespondWithError(w, 400, err.Error())
+			return
+		}
+
+		hash, fee, err := sendBatch(config, batch, feeRate, selector)
+		if err == errSendUnresolved {
+			// the tx may be paid already, it must not be sent again
+			RespondWithError(w, 500, fmt.Sprintf("%v, tx: %s", err, hash))
+			return
+		}
+		if err != nil {
+			RespondWithError(w, 500, err.Error())
+			return
+		}
+
+		results := make([]map[string]interface{}, 0, len(batch))
+		for _, o := range batch {
+			results = append(results, map[string]interface{}{
+				"requestId": o.RequestId,
+				"to":        o.Address,
+				"amount":    util.LeftShift(strconv.FormatInt(o.Amount, 10), 8),
+				"index":     o.Index,
+				"fee":       util.LeftShift(strconv.FormatInt(o.Fee, 10), 8),
+			})
+		}
+		Respond(w, 0, map[string]interface{}{
+			"txhash":  hash,
+			"fee":     util.LeftShift(strconv.FormatInt(fee, 10), 8),
+			"feeRate": strconv.FormatUint(uint64(feeRate), 10),
+			"outputs": results,
+		})
 	}
 }
 
@@ -169,7 +290,7 @@ func PrepareTrezorSignHandler(config *conf.Config) func(w http.ResponseWriter, r
 			}
 		}
 
-		changeAddress, err := util.GetNewChangeAddr(config, config.InIndex)
+		changeAddress, err := peekAddress(config, util.BRANCH_INTERNAL)
 		if err != nil {
 			log.Println("get change address err:", err)
 			return
@@ -179,24 +300,48 @@ func PrepareTrezorSignHandler(config *conf.Config) func(w http.ResponseWriter, r
 			to, _ = util.ConvertCashAddrToLegacy(to, param)
 			changeAddress, _ = util.ConvertCashAddrToLegacy(changeAddress, param)
 		}
+		feeRate, err := feeRateFromRequest(config, r)
+		if err != nil {
+			RespondWithError(w, 400, err.Error())
+			return
+		}
+
+		selector, err := coinSelectorFromRequest(config, "prepareTrezorSign", r)
+		if err != nil {
+			RespondWithError(w, 400, err.Error())
+			return
+		}
+
 		outputs := make([]TxOut, 1)
 		outputs[0] = TxOut{Address: to, Amount: amount}
-		tx, hasChange := CreateTxForOutputs(config.FeeRate, "", outputs, changeAddress, param, false, false)
+		tx, hasChange := CreateTxForOutputs(feeRate, "", outputs, changeAddress, param, false, false, selector)
 		if tx == nil {
 			RespondWithError(w, 500, "utxo out of balance")
 			return
 		}
+		fee := txFeePaid(tx)
 
 		trezorTx, err := PrepareTrezorSign(config, tx)
 		if err != nil {
 			RespondWithError(w, 500, fmt.Sprintf("prepare trezor sign err:%v", err))
 			return
 		}
+		reservationId, err := reserveInputs(tx, time.Duration(config.ReserveTimeout)*time.Second)
+		if err != nil {
+			RespondWithError(w, 500, fmt.Sprintf("reserve utxo err:%v", err))
+			return
+		}
 		if hasChange {
-			util.StoreAddrPath(changeAddress, fmt.Sprintf("1/%d", config.InIndex))
-			config.InIndex++
+			if _, err = issueAddress(config, util.BRANCH_INTERNAL, PURPOSE_CHANGE, "", ""); err != nil {
+				log.Println("issue change address err:", err)
+			}
 		}
-		Respond(w, 0, map[string]string{"trezorTx": trezorTx})
+		Respond(w, 0, map[string]string{
+			"trezorTx":      trezorTx,
+			"reservationId": reservationId,
+			"fee":           util.LeftShift(strconv.FormatInt(fee, 10), 8),
+			"feeRate":       strconv.FormatUint(uint64(feeRate), 10),
+		})
 	}
 }
 
@@ -204,22 +349,27 @@ func GetAddrHandler(config *conf.Config) func(w http.ResponseWriter, r *http.Req
 	return func(w http.ResponseWriter, r *http.Request) {
 		m.Lock()
 		defer m.Unlock()
-		addr, err := util.GetNewExternalAddr(config, config.Index)
+		err := r.ParseForm()
+		if err != nil {
+			RespondWithError(w, 400, "Could not parse parameters")
+			return
+		}
+		userId := r.Form.Get("userId")
+		label := r.Form.Get("label")
+		if err = checkAddressLabel(userId, label); err != nil {
+			RespondWithError(w, 400, err.Error())
+			return
+		}
+
+		rec, err := issueAddress(config, util.BRANCH_EXTERNAL, PURPOSE_DEPOSIT, userId, label)
 		if err != nil {
 			log.Println("create address error: ", err)
 			RespondWithError(w, 500, "Couldn't create eth address")
 			return
 		}
-		param := util.GetParamByName(config.ChainName)
-		if strings.HasPrefix(strings.ToLower(config.ChainName), "bch") {
-			addr, _ = util.ConvertLegacyToCashAddr(addr, param)
-			addr = addr[len(param.Bech32HRPSegwit)+1:]
-		}
-		log.Println("send addr:", addr, config.Index)
-		util.StoreAddrPath(addr, fmt.Sprintf("0/%d", config.Index))
-		config.Index++
+		log.Println("send addr:", rec.Address, rec.Path, "user:", userId)
 
-		Respond(w, 0, addr)
+		Respond(w, 0, rec.Address)
 	}
 }
 
@@ -234,7 +384,11 @@ func GetInnerBalanceHandler(config *conf.Config) func(w http.ResponseWriter, r *
 			return
 		}
 
-		Respond(w, 0, map[string]string{"balance": util.LeftShift(balance.String(), 8)})
+		Respond(w, 0, map[string]string{
+			"balance": util.LeftShift(balance.Spendable.String(), 8),
+			"dust":    util.LeftShift(balance.Dust.String(), 8),
+			"frozen":  util.LeftShift(balance.Frozen.String(), 8),
+		})
 	}
 }
 
@@ -256,7 +410,11 @@ func GetBalanceHandler(config *conf.Config) func(w http.ResponseWriter, r *http.
 			return
 		}
 
-		Respond(w, 0, map[string]string{"balance": util.LeftShift(balance.String(), 8)})
+		Respond(w, 0, map[string]string{
+			"balance": util.LeftShift(balance.Spendable.String(), 8),
+			"dust":    util.LeftShift(balance.Dust.String(), 8),
+			"frozen":  util.LeftShift(balance.Frozen.String(), 8),
+		})
 	}
 }
 
@@ -289,15 +447,15 @@ func SendSignedTxHandler(config *conf.Config) func(w http.ResponseWriter, r *htt
 			return
 		}
 
-		hash, err := SendTransaction(config, &tx)
+		hash, err := broadcastTx(config, &tx, 0)
 		if err != nil {
 			log.Println("send signed tx error: ", err)
 			RespondWithError(w, 500, fmt.Sprintf("send signed tx err: %v", err))
 			return
 		}
 		log.Println("send signed tx ok:", hash)
-		if err = ParseMempoolTransaction(config, &tx, config.ChainName); err != nil {
-			log.Println("parse signed tx error:", err)
+		if err = releaseInputs(&tx); err != nil {
+			log.Println("release reserved utxo error:", err)
 		}
 
 		Respond(w, 0, map[string]string{"hash": hash})
@@ -404,10 +562,16 @@ func SendOmniCoinHandler(config *conf.Config) func(w http.ResponseWriter, r *htt
 			return
 		}
 
+		selector, err := coinSelectorFromRequest(config, "sendOmniCoin", r)
+		if err != nil {
+			RespondWithError(w, 400, err.Error())
+			return
+		}
+
 		outputs := make([]TxOut, 2)
 		outputs[0] = TxOut{Script: usdt.GetOmniUsdtScript(uint64(amount))}
 		outputs[1] = TxOut{Address: to, Amount: 546}
-		tx, _ := CreateTxForOutputs(config.FeeRate, from, outputs, "", param, true, true)
+		tx, _ := CreateTxForOutputs(config.FeeRate, from, outputs, "", param, true, true, selector)
 		if tx == nil {
 			RespondWithError(w, 500, "utxo out of balance")
 			return
@@ -420,15 +584,12 @@ func SendOmniCoinHandler(config *conf.Config) func(w http.ResponseWriter, r *htt
 		}
 		hash := signedTx.TxHash().String()
 
-		hash, err = SendTransaction(config, signedTx)
+		hash, err = broadcastTx(config, signedTx, config.FeeRate)
 		if err != nil {
 			RespondWithError(w, 500, fmt.Sprintf("send tx err:%v", err))
 			return
 		}
 		log.Println("send omni tx ok:", hash)
-		if err = ParseMempoolTransaction(config, signedTx, config.ChainName); err != nil {
-			log.Println("parse omni tx error:", err)
-		}
 		Respond(w, 0, map[string]string{"txhash": hash})
 	}
 }
@@ -506,16 +667,22 @@ func PrepareOmniTrezorSignHandler(config *conf.Config) func(w http.ResponseWrite
 			}
 		}
 
-		changeAddress, err := util.GetNewChangeAddr(config, config.InIndex)
+		changeAddress, err := peekAddress(config, util.BRANCH_INTERNAL)
 		if err != nil {
 			log.Println("get change address err:", err)
 			return
 		}
 
+		selector, err := coinSelectorFromRequest(config, "prepareOmniTrezorSign", r)
+		if err != nil {
+			RespondWithError(w, 400, err.Error())
+			return
+		}
+
 		outputs := make([]TxOut, 2)
 		outputs[0] = TxOut{Script: usdt.GetOmniUsdtScript(uint64(amount))}
 		outputs[1] = TxOut{Address: to, Amount: 546}
-		tx, hasChange := CreateTxForOutputs(config.FeeRate, from, outputs, changeAddress, param, false, true)
+		tx, hasChange := CreateTxForOutputs(config.FeeRate, from, outputs, changeAddress, param, false, true, selector)
 		if tx == nil {
 			RespondWithError(w, 500, "utxo out of balance")
 			return
@@ -530,11 +697,17 @@ func PrepareOmniTrezorSignHandler(config *conf.Config) func(w http.ResponseWrite
 			RespondWithError(w, 500, fmt.Sprintf("prepare trezor sign err:%v", err))
 			return
 		}
+		reservationId, err := reserveInputs(tx, time.Duration(config.ReserveTimeout)*time.Second)
+		if err != nil {
+			RespondWithError(w, 500, fmt.Sprintf("reserve utxo err:%v", err))
+			return
+		}
 		if hasChange {
-			util.StoreAddrPath(changeAddress, fmt.Sprintf("1/%d", config.InIndex))
-			config.InIndex++
+			if _, err = issueAddress(config, util.BRANCH_INTERNAL, PURPOSE_CHANGE, "", ""); err != nil {
+				log.Println("issue change address err:", err)
+			}
 		}
-		Respond(w, 0, map[string]string{"trezorTx": trezorTx})
+		Respond(w, 0, map[string]string{"trezorTx": trezorTx, "reservationId": reservationId})
 	}
 }
 
@@ -593,3 +766,789 @@ func CheckAddrHandler(config *conf.Config) func(w http.ResponseWriter, r *http.R
 		}
 	}
 }
+
+func addressRecordResult(rec *AddressRecord) map[string]interface{} {
+	return map[string]interface{}{
+		"address": rec.Address,
+		"path":    rec.Path.String(),
+		"created": rec.Created,
+		"userId":  rec.UserId,
+		"label":   rec.Label,
+		"purpose": rec.Purpose,
+	}
+}
+
+// LookupAddressHandler returns the registry record of an address, or the
+// addresses bound to a user.
+func LookupAddressHandler(config *conf.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		addr := r.URL.Query().Get("address")
+		userId := r.URL.Query().Get("userId")
+		if (addr == "") == (userId == "") {
+			RespondWithError(w, 400, "either address or userId is required")
+			return
+		}
+
+		if addr != "" {
+			rec, err := lookupAddress(addr)
+			if err != nil {
+				RespondWithError(w, 404, "address not found")
+				return
+			}
+			Respond(w, 0, addressRecordResult(rec))
+			return
+		}
+
+		if err := checkAddressLabel(userId, ""); err != nil {
+			RespondWithError(w, 400, err.Error())
+			return
+		}
+		recs, err := userAddresses(userId)
+		if err != nil {
+			log.Println("lookup user addresses err:", err)
+			RespondWithError(w, 500, "lookup address fail")
+			return
+		}
+		res := make([]map[string]interface{}, 0, len(recs))
+		for i := range recs {
+			res = append(res, addressRecordResult(&recs[i]))
+		}
+		Respond(w, 0, res)
+	}
+}
+
+// RevertedTxsHandler lists the delivered txs orphaned by a reorg, the ones
+// of a tx when hash is given.
+func RevertedTxsHandler(config *conf.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txs, err := revertedTxs(r.URL.Query().Get("hash"))
+		if err != nil {
+			log.Println("list reverted txs err:", err)
+			RespondWithError(w, 500, "list reverted txs fail")
+			return
+		}
+		Respond(w, 0, txs)
+	}
+}
+
+// ClearRevertedHandler drops the reverted records of a tx settled by the
+// operators.
+func ClearRevertedHandler(config *conf.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			RespondWithError(w, 400, "Could not parse parameters")
+			return
+		}
+		hash := r.Form.Get("hash")
+		if hash == "" {
+			RespondWithError(w, 400, "hash is required")
+			return
+		}
+
+		n, err := clearRevertedTxs(hash)
+		if err != nil {
+			log.Println("clear reverted txs err:", err, hash)
+			RespondWithError(w, 500, "clear reverted txs fail")
+			return
+		}
+		Respond(w, 0, map[string]interface{}{"cleared": n})
+	}
+}
+
+func ListReservationsHandler(config *conf.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		reservations, err := listReservations()
+		if err != nil {
+			log.Println("list reservations err:", err)
+			RespondWithError(w, 500, "list reservations fail")
+			return
+		}
+
+		Respond(w, 0, reservations)
+	}
+}
+
+func ReleaseReservationHandler(config *conf.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			RespondWithError(w, 400, "Could not parse parameters")
+			return
+		}
+
+		id := r.Form.Get("id")
+		hash := r.Form.Get("hash")
+		indexStr := r.Form.Get("index")
+
+		if id != "" {
+			n, err := releaseReservation(id)
+			if err != nil {
+				log.Println("release reservation err:", err, id)
+				RespondWithError(w, 500, "release reservation fail")
+				return
+			}
+			log.Println("release reservation", id, "utxos:", n)
+			Respond(w, 0, map[string]int{"released": n})
+			return
+		}
+
+		if hash == "" || indexStr == "" {
+			RespondWithError(w, 400, "Missing id or hash and index")
+			return
+		}
+		index, err := strconv.ParseUint(indexStr, 10, 32)
+		if err != nil {
+			RespondWithError(w, 400, "invalid index")
+			return
+		}
+		if err = releaseOutpoint(hash, uint32(index)); err != nil {
+			log.Println("release utxo err:", err, hash, index)
+			RespondWithError(w, 404, "reservation not found")
+			return
+		}
+		log.Println("release reserved utxo", hash, index)
+		Respond(w, 0, map[string]int{"released": 1})
+	}
+}
+
+func withdrawalResult(wd *Withdrawal) map[string]interface{} {
+	return map[string]interface{}{
+		"id":        strconv.FormatUint(wd.Id, 10),
+		"requestId": wd.RequestId,
+		"to":        wd.To,
+		"amount":    util.LeftShift(strconv.FormatInt(wd.Amount, 10), 8),
+		"state":     withdrawalStateNames[wd.State],
+		"txhash":    wd.TxHash,
+		"fee":       util.LeftShift(strconv.FormatInt(wd.Fee, 10), 8),
+		"error":     wd.Error,
+		"created":   wd.Created,
+		"updated":   wd.Updated,
+	}
+}
+
+// EnqueueWithdrawalHandler queues a payment for the withdrawal scheduler.
+func EnqueueWithdrawalHandler(config *conf.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			RespondWithError(w, 400, "Could not parse parameters")
+			return
+		}
+
+		to := r.Form.Get("to")
+		amountStr := r.Form.Get("amount")
+		requestId := r.Form.Get("requestId")
+
+		if to == "" {
+			RespondWithError(w, 400, "Missing to field")
+			return
+		}
+		if !util.VerifyAddress(config.ChainName, to) {
+			log.Println("Invalid to address:", to)
+			RespondWithError(w, 400, "Invalid to address")
+			return
+		}
+		if amountStr == "" {
+			RespondWithError(w, 400, "Missing amount field")
+			return
+		}
+		amount, err := strconv.ParseInt(util.RightShift(amountStr, 8), 10, 64)
+		if err != nil || amount <= 0 {
+			RespondWithError(w, 400, "invalid amount")
+			return
+		}
+
+		wd, queued, err := enqueueWithdrawal(to, amount, requestId)
+		if err == errRequestIdTaken {
+			RespondWithError(w, 409, fmt.Sprintf("requestId %s used by another withdrawal", requestId))
+			return
+		} else if err != nil {
+			log.Println("enqueue withdrawal err:", err)
+			RespondWithError(w, 500, "enqueue withdrawal fail")
+			return
+		}
+		if !queued {
+			log.Println("withdrawal request", wd.RequestId, "already queued as", wd.Id)
+			Respond(w, 0, withdrawalResult(wd))
+			return
+		}
+		log.Println("queue withdrawal", wd.Id, "to", to, "amount:", amountStr, "request:", wd.RequestId)
+		wakeWithdrawalScheduler(config)
+		Respond(w, 0, withdrawalResult(wd))
+	}
+}
+
+func GetWithdrawalHandler(config *conf.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+		if err != nil {
+			RespondWithError(w, 400, "invalid id")
+			return
+		}
+
+		wd, err := getWithdrawal(id)
+		if err != nil {
+			RespondWithError(w, 404, "withdrawal not found")
+			return
+		}
+		Respond(w, 0, withdrawalResult(wd))
+	}
+}
+
+// BumpFeeHandler replaces an unconfirmed withdrawal by one paying a higher fee rate.
+func BumpFeeHandler(config *conf.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		defer m.Unlock()
+
+		err := r.ParseForm()
+		if err != nil {
+			RespondWithError(w, 400, "Could not parse parameters")
+			return
+		}
+
+		txid := r.Form.Get("txid")
+		if txid == "" {
+			RespondWithError(w, 400, "Missing txid field")
+			return
+		}
+		if r.Form.Get("feeRate") == "" && r.Form.Get("feeTarget") == "" {
+			RespondWithError(w, 400, "Missing feeRate or feeTarget field")
+			return
+		}
+		feeRate, err := feeRateFromRequest(config, r)
+		if err != nil {
+			RespondWithError(w, 400, err.Error())
+			return
+		}
+		selector, err := coinSelectorFromRequest(config, "bumpFee", r)
+		if err != nil {
+			RespondWithError(w, 400, err.Error())
+			return
+		}
+
+		replacement, err := bumpFee(config, txid, feeRate, selector)
+		if err != nil {
+			log.Println("bump fee err:", err, txid)
+			RespondWithError(w, 500, err.Error())
+			return
+		}
+		Respond(w, 0, map[string]string{
+			"txhash":   replacement.Hash,
+			"replaces": txid,
+			"fee":      util.LeftShift(strconv.FormatInt(replacement.Fee, 10), 8),
+			"feeRate":  strconv.FormatUint(uint64(feeRate), 10),
+		})
+	}
+}
+
+// AccelerateHandler spends an unconfirmed deposit with a fee high enough to
+// get the deposit mined at the target rate.
+func AccelerateHandler(config *conf.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		defer m.Unlock()
+
+		err := r.ParseForm()
+		if err != nil {
+			RespondWithError(w, 400, "Could not parse parameters")
+			return
+		}
+
+		txid := r.Form.Get("txid")
+		if txid == "" {
+			RespondWithError(w, 400, "Missing txid field")
+			return
+		}
+		feeRate, err := feeRateFromRequest(config, r)
+		if err != nil {
+			RespondWithError(w, 400, err.Error())
+			return
+		}
+
+		a, err := accelerate(config, txid, feeRate)
+		if err != nil {
+			log.Println("accelerate tx err:", err, txid)
+			RespondWithError(w, 500, err.Error())
+			return
+		}
+		Respond(w, 0, map[string]string{
+			"txhash":         a.Tx.Hash,
+			"parent":         a.Parent,
+			"fee":            util.LeftShift(strconv.FormatInt(a.Tx.Fee, 10), 8),
+			"packageFee":     util.LeftShift(strconv.FormatInt(a.PackageFee, 10), 8),
+			"packageSize":    strconv.FormatInt(a.PackageSize, 10),
+			"packageFeeRate": strconv.FormatInt(a.PackageRate, 10),
+		})
+	}
+}
+
+func TxStatusHandler(config *conf.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s, err := getSentTx(mux.Vars(r)["hash"])
+		if err != nil {
+			RespondWithError(w, 404, "tx not found")
+			return
+		}
+
+		Respond(w, 0, map[string]interface{}{
+			"txhash":        s.Hash,
+			"hex":           s.Raw,
+			"status":        sentStatusNames[s.Status],
+			"confirmations": s.Confirmations,
+			"fee":           util.LeftShift(strconv.FormatInt(s.Fee, 10), 8),
+			"rebroadcasts":  s.Rebroadcasts,
+			"replaces":      s.Replaces,
+			"replacedBy":    s.ReplacedBy,
+			"error":         s.Error,
+			"created":       s.Created,
+			"checked":       s.Checked,
+		})
+	}
+}
+
+// SweepHandler collects the deposit utxos into the inner addresses now.
+func SweepHandler(config *conf.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		defer m.Unlock()
+
+		err := r.ParseForm()
+		if err != nil {
+			RespondWithError(w, 400, "Could not parse parameters")
+			return
+		}
+		if r.Form.Get("feeRate") == "" && r.Form.Get("feeTarget") == "" {
+			r.Form.Set("feeTarget", config.SweepFeeTarget)
+		}
+		feeRate, err := feeRateFromRequest(config, r)
+		if err != nil {
+			RespondWithError(w, 400, err.Error())
+			return
+		}
+
+		sent, err := sweepDeposits(config, feeRate)
+		if err != nil {
+			log.Println("sweep deposits err:", err)
+			if len(sent) == 0 {
+				RespondWithError(w, 500, err.Error())
+				return
+			}
+		}
+
+		txs := make([]map[string]string, 0, len(sent))
+		for _, s := range sent {
+			txs = append(txs, map[string]string{
+				"txhash": s.Hash,
+				"inputs": strconv.Itoa(len(s.Inputs)),
+				"fee":    util.LeftShift(strconv.FormatInt(s.Fee, 10), 8),
+			})
+		}
+		Respond(w, 0, map[string]interface{}{
+			"feeRate": strconv.FormatUint(uint64(feeRate), 10),
+			"txs":     txs,
+		})
+	}
+}
+
+func consolidationResult(report *ConsolidationReport) map[string]interface{} {
+	return map[string]interface{}{
+		"time":        report.Time,
+		"feeRate":     strconv.FormatUint(uint64(report.FeeRate), 10),
+		"utxosBefore": report.UtxosBefore,
+		"utxosAfter":  report.UtxosAfter,
+		"inputs":      report.Inputs,
+		"fee":         util.LeftShift(strconv.FormatInt(report.Fee, 10), 8),
+		"txs":         report.Txs,
+		"skipped":     report.Skipped,
+	}
+}
+
+// ConsolidateHandler merges the inner utxos now. The fee rate threshold is
+// ignored when force is set.
+func ConsolidateHandler(config *conf.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		defer m.Unlock()
+
+		err := r.ParseForm()
+		if err != nil {
+			RespondWithError(w, 400, "Could not parse parameters")
+			return
+		}
+		if r.Form.Get("feeRate") == "" && r.Form.Get("feeTarget") == "" {
+			r.Form.Set("feeTarget", config.ConsolidateFeeTarget)
+		}
+		feeRate, err := feeRateFromRequest(config, r)
+		if err != nil {
+			RespondWithError(w, 400, err.Error())
+			return
+		}
+
+		report := consolidate(config, feeRate, r.Form.Get("force") == "true")
+		Respond(w, 0, consolidationResult(report))
+	}
+}
+
+// ConsolidationsHandler lists the last consolidation check and the latest
+// runs which sent txs.
+func ConsolidationsHandler(config *conf.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		reports, err := consolidationReports(MAX_CONSOLIDATION_REPORTS)
+		if err != nil {
+			log.Println("list consolidations err:", err)
+			RespondWithError(w, 500, "Could not list consolidations")
+			return
+		}
+
+		runs := make([]map[string]interface{}, 0, len(reports))
+		for i := range reports {
+			runs = append(runs, consolidationResult(&reports[i]))
+		}
+		res := map[string]interface{}{"runs": runs}
+		consolidationLock.Lock()
+		if lastConsolidation != nil {
+			res["last"] = consolidationResult(lastConsolidation)
+		}
+		consolidationLock.Unlock()
+		Respond(w, 0, res)
+	}
+}
+
+// outpointsFromRequest returns the comma separated "hash:index" list of the
+// utxos parameter.
+func outpointsFromRequest(r *http.Request) []string {
+	outpoints := make([]string, 0)
+	for _, str := range strings.Split(r.Form.Get("utxos"), ",") {
+		if str = strings.TrimSpace(str); str != "" {
+			outpoints = append(outpoints, str)
+		}
+	}
+	return outpoints
+}
+
+// DustHandler lists the frozen dust utxos.
+func DustHandler(config *conf.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dust, err := dustUtxos(nil)
+		if err != nil {
+			log.Println("list dust err:", err)
+			RespondWithError(w, 500, "Could not list dust")
+			return
+		}
+
+		var total int64
+		utxos := make([]map[string]string, 0, len(dust))
+		for _, u := range dust {
+			total += u.Value
+			utxos = append(utxos, map[string]string{
+				"utxo":      fmt.Sprintf("%s:%d", u.Hash, u.Index),
+				"address":   u.Address,
+				"amount":    util.LeftShift(strconv.FormatInt(u.Value, 10), 8),
+				"threshold": util.LeftShift(strconv.FormatInt(dustThreshold(u.Script), 10), 8),
+			})
+		}
+		Respond(w, 0, map[string]interface{}{
+			"total": util.LeftShift(strconv.FormatInt(total, 10), 8),
+			"utxos": utxos,
+		})
+	}
+}
+
+// SpendDustHandler merges the given dust utxos, all of them by default, into
+// an inner address.
+func SpendDustHandler(config *conf.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		defer m.Unlock()
+
+		err := r.ParseForm()
+		if err != nil {
+			RespondWithError(w, 400, "Could not parse parameters")
+			return
+		}
+		if r.Form.Get("feeRate") == "" && r.Form.Get("feeTarget") == "" {
+			r.Form.Set("feeTarget", "economy")
+		}
+		feeRate, err := feeRateFromRequest(config, r)
+		if err != nil {
+			RespondWithError(w, 400, err.Error())
+			return
+		}
+		dust, err := dustUtxos(outpointsFromRequest(r))
+		if err != nil {
+			RespondWithError(w, 400, err.Error())
+			return
+		}
+
+		s, err := spendDust(config, dust, feeRate)
+		if err != nil {
+			log.Println("spend dust err:", err)
+			RespondWithError(w, 500, err.Error())
+			return
+		}
+		Respond(w, 0, map[string]string{
+			"txhash": s.Hash,
+			"inputs": strconv.Itoa(len(s.Inputs)),
+			"fee":    util.LeftShift(strconv.FormatInt(s.Fee, 10), 8),
+		})
+	}
+}
+
+// AbandonDustHandler removes the given dust utxos from the wallet.
+func AbandonDustHandler(config *conf.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		defer m.Unlock()
+
+		err := r.ParseForm()
+		if err != nil {
+			RespondWithError(w, 400, "Could not parse parameters")
+			return
+		}
+		outpoints := outpointsFromRequest(r)
+		if len(outpoints) == 0 {
+			RespondWithError(w, 400, "Missing utxos field")
+			return
+		}
+		dust, err := dustUtxos(outpoints)
+		if err != nil {
+			RespondWithError(w, 400, err.Error())
+			return
+		}
+
+		if err = abandonDust(dust); err != nil {
+			log.Println("abandon dust err:", err)
+			RespondWithError(w, 500, "Could not abandon dust")
+			return
+		}
+		Respond(w, 0, map[string]int{"abandoned": len(dust)})
+	}
+}
+
+// FreezeHandler keeps the given utxos from being spent until they are
+// unfrozen. A reason and the operator name are required.
+func FreezeHandler(config *conf.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		defer m.Unlock()
+
+		err := r.ParseForm()
+		if err != nil {
+			RespondWithError(w, 400, "Could not parse parameters")
+			return
+		}
+		outpoints := outpointsFromRequest(r)
+		if len(outpoints) == 0 {
+			RespondWithError(w, 400, "Missing utxos field")
+			return
+		}
+
+		freezes, err := freezeOutpoints(outpoints, r.Form.Get("reason"), r.Form.Get("operator"))
+		if err != nil {
+			RespondWithError(w, 400, err.Error())
+			return
+		}
+		Respond(w, 0, map[string]int{"frozen": len(freezes)})
+	}
+}
+
+func UnfreezeHandler(config *conf.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		defer m.Unlock()
+
+		err := r.ParseForm()
+		if err != nil {
+			RespondWithError(w, 400, "Could not parse parameters")
+			return
+		}
+		outpoints := outpointsFromRequest(r)
+		if len(outpoints) == 0 {
+			RespondWithError(w, 400, "Missing utxos field")
+			return
+		}
+
+		if err = unfreezeOutpoints(outpoints, r.Form.Get("reason"), r.Form.Get("operator")); err != nil {
+			RespondWithError(w, 400, err.Error())
+			return
+		}
+		Respond(w, 0, map[string]int{"unfrozen": len(outpoints)})
+	}
+}
+
+// FrozenHandler lists the frozen utxos.
+func FrozenHandler(config *conf.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		freezes, err := listFreezes()
+		if err != nil {
+			log.Println("list freezes err:", err)
+			RespondWithError(w, 500, "Could not list frozen utxos")
+			return
+		}
+
+		res := make([]map[string]interface{}, 0, len(freezes))
+		for _, f := range freezes {
+			item := map[string]interface{}{
+				"utxo":     fmt.Sprintf("%s:%d", f.Hash, f.Index),
+				"reason":   f.Reason,
+				"operator": f.Operator,
+				"created":  f.Created,
+			}
+			// the outpoint may not be in the utxo set yet
+			if out, err := GetUtxoByKey(f.Hash, f.Index); err == nil {
+				item["address"] = out.Address
+				item["amount"] = util.LeftShift(strconv.FormatInt(out.Amount, 10), 8)
+			}
+			res = append(res, item)
+		}
+		Respond(w, 0, res)
+	}
+}
+
+// FreezeHistoryHandler returns the audit trail of the freezes, of a single
+// utxo when given.
+func FreezeHistoryHandler(config *conf.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			hash  string
+			index uint32
+			err   error
+		)
+		if str := r.URL.Query().Get("utxo"); str != "" {
+			if hash, index, err = parseOutpoint(str); err != nil {
+				RespondWithError(w, 400, err.Error())
+				return
+			}
+		}
+
+		events, err := freezeHistory(hash, index)
+		if err != nil {
+			log.Println("get freeze history err:", err)
+			RespondWithError(w, 500, "Could not get freeze history")
+			return
+		}
+
+		res := make([]map[string]interface{}, 0, len(events))
+		for _, e := range events {
+			res = append(res, map[string]interface{}{
+				"utxo":     fmt.Sprintf("%s:%d", e.Hash, e.Index),
+				"action":   e.Action,
+				"reason":   e.Reason,
+				"operator": e.Operator,
+				"time":     e.Time,
+			})
+		}
+		Respond(w, 0, res)
+	}
+}
+
+// ReconcileHandler compares the utxo db with the node and fixes it on
+// demand. The rescan starts at the from height when given.
+func ReconcileHandler(config *conf.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			RespondWithError(w, 400, "Could not parse parameters")
+			return
+		}
+		var from int64
+		if str := r.Form.Get("from"); str != "" {
+			if from, err = strconv.ParseInt(str, 10, 64); err != nil || from <= 0 {
+				RespondWithError(w, 400, "invalid from height")
+				return
+			}
+		}
+
+		report, err := reconcileUtxos(config, from, r.Form.Get("fix") == "true")
+		if err != nil {
+			log.Println("reconcile utxo err:", err)
+			RespondWithError(w, 500, err.Error())
+			return
+		}
+
+		diffs := make([]map[string]interface{}, 0, len(report.Diffs))
+		for _, d := range report.Diffs {
+			diffs = append(diffs, map[string]interface{}{
+				"kind":    d.Kind,
+				"utxo":    fmt.Sprintf("%s:%d", d.Utxo.Hash, d.Utxo.Index),
+				"address": d.Utxo.Address,
+				"amount":  util.LeftShift(strconv.FormatInt(d.Utxo.Value, 10), 8),
+				"height":  d.Utxo.Height,
+				"detail":  d.Detail,
+				"fixed":   d.Fixed,
+			})
+		}
+		Respond(w, 0, map[string]interface{}{
+			"method":    report.Method,
+			"from":      report.From,
+			"checked":   report.Checked,
+			"addresses": report.Addresses,
+			"diffs":     diffs,
+		})
+	}
+}
+
+func DiscoverHandler(config *conf.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			RespondWithError(w, 400, "Could not parse parameters")
+			return
+		}
+		gap := config.GapLimit
+		if str := r.Form.Get("gap"); str != "" {
+			n, err := strconv.ParseUint(str, 10, 32)
+			if err != nil || n == 0 {
+				RespondWithError(w, 400, "invalid gap")
+				return
+			}
+			gap = uint32(n)
+		}
+		if gap == 0 {
+			RespondWithError(w, 400, "gap limit is not set")
+			return
+		}
+		var from int64
+		if str := r.Form.Get("from"); str != "" {
+			if from, err = strconv.ParseInt(str, 10, 64); err != nil || from <= 0 {
+				RespondWithError(w, 400, "invalid from height")
+				return
+			}
+		}
+
+		report, err := discoverAddresses(config, gap, from)
+		if err != nil {
+			log.Println("discover address err:", err)
+			RespondWithError(w, 500, err.Error())
+			return
+		}
+
+		branches := make([]map[string]interface{}, 0, len(report.Branches))
+		for _, b := range report.Branches {
+			branches = append(branches, map[string]interface{}{
+				"branch": b.Branch,
+				"before": b.Before,
+				"after":  b.After,
+			})
+		}
+		utxos := make([]map[string]interface{}, 0, len(report.Utxos))
+		for _, u := range report.Utxos {
+			utxos = append(utxos, map[string]interface{}{
+				"utxo":    fmt.Sprintf("%s:%d", u.Hash, u.Index),
+				"address": u.Address,
+				"amount":  util.LeftShift(strconv.FormatInt(u.Value, 10), 8),
+				"height":  u.Height,
+			})
+		}
+		Respond(w, 0, map[string]interface{}{
+			"method":   report.Method,
+			"from":     report.From,
+			"gap":      report.Gap,
+			"derived":  report.Derived,
+			"branches": branches,
+			"utxos":    utxos,
+		})
+	}
+}
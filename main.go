@@ -33,6 +33,13 @@ type NotifyMessage struct {
 	Coin        string
 	TxType      int
 	BlockTime   uint64
+	Reverted    bool
+	// withdrawal request paid by the output of a batch tx
+	RequestId string
+	// index of the output paying the withdrawal
+	OutputIndex uint32
+	// first tx of the fee bumps ending with TxHash
+	OrigTxHash string
 }
 
 var (
@@ -50,6 +57,16 @@ var (
 	index   int
 	addr    string
 	value   int64
+
+	reconcile     bool
+	reconcileFix  bool
+	reconcileFrom int64
+
+	rescanHeight int64
+
+	benchFrom    int64
+	benchBlocks  int64
+	fetchWorkers int
 )
 
 func init() {
@@ -64,6 +81,15 @@ func init() {
 	flag.IntVar(&index, "index", 0, "tx output index")
 	flag.StringVar(&addr, "addr", "", "tx output address")
 	flag.Int64Var(&value, "value", 0, "tx output amount")
+
+	flag.BoolVar(&reconcile, "reconcile", false, "compare the utxo db with the node and then exit")
+	flag.BoolVar(&reconcileFix, "fix", false, "fix the utxo db with -reconcile")
+	flag.Int64Var(&reconcileFrom, "from", 0, "rescan from this height instead of scantxoutset with -reconcile")
+	flag.Int64Var(&rescanHeight, "rescan-from", -1, "rebuild the db by rescanning from this height and then exit")
+
+	flag.Int64Var(&benchFrom, "bench-from", -1, "measure the block catch-up from this height and then exit")
+	flag.Int64Var(&benchBlocks, "bench-blocks", 100, "blocks read with -bench-from")
+	flag.IntVar(&fetchWorkers, "workers", 0, "blocks fetched at once while catching up, 0 for the config value")
 }
 
 func main() {
@@ -97,27 +123,82 @@ func main() {
 
 	last_id = config.LastBlock
 
-	util.AddressInit(config.Xpub, 0, int(config.Index), param)
-	util.AddressInit(config.Xpub, 1, int(config.InIndex), param)
-
 	err = openDb(config.DBDir)
 	if err != nil {
 		log.Println("open db err:", err)
 		return
 	}
+	if err = loadAddressRegistry(config, param); err != nil {
+		log.Println("load address registry err:", err)
+		closeDb()
+		return
+	}
+	if err = migrateUtxoDb(param); err != nil {
+		log.Println("migrate db err:", err)
+		closeDb()
+		return
+	}
+	setDustRelayFee(config.DustRelayFee)
+	if err = freezeDust(); err != nil {
+		log.Println("freeze dust err:", err)
+	}
 
 	if addUtxo {
-		createUtxo(hash, uint32(index), addr, value)
+		createUtxo(Utxo{Hash: hash, Index: uint32(index), Address: addr, Value: value})
 		return
 	}
 	if rmUtxo {
-		removeUtxo(hash, uint32(index), "", 0)
+		removeUtxo(hash, uint32(index))
+		return
+	}
+	if fetchWorkers > 0 {
+		config.FetchWorkers = fetchWorkers
+	}
+	if benchFrom >= 0 {
+		if err = benchmarkCatchUp(config, benchFrom, benchBlocks); err != nil {
+			log.Println("bench err:", err)
+		}
+		closeDb()
+		return
+	}
+	if rescanHeight >= 0 {
+		if err = rescanFrom(config, param, uint64(rescanHeight)); err != nil {
+			log.Println("rescan err:", err)
+			closeDb()
+			return
+		}
+		conf.SaveConfiguration(config, fConfigFile)
+		return
+	}
+	if reconcile {
+		report, err := reconcileUtxos(config, reconcileFrom, reconcileFix)
+		if err != nil {
+			log.Println("reconcile utxo err:", err)
+		} else {
+			printReconcileReport(report)
+		}
+		closeDb()
 		return
 	}
 
 	r := mux.NewRouter()
 	r.HandleFunc("/getAddress", GetAddrHandler(config))
 	r.HandleFunc("/sendCoin", SendCoinHandler(config))
+	r.HandleFunc("/sendMany", SendManyHandler(config))
+	r.HandleFunc("/bumpFee", BumpFeeHandler(config))
+	r.HandleFunc("/accelerate", AccelerateHandler(config))
+	r.HandleFunc("/sweep", SweepHandler(config))
+	r.HandleFunc("/consolidate", ConsolidateHandler(config))
+	r.HandleFunc("/consolidations", ConsolidationsHandler(config))
+	r.HandleFunc("/dust", DustHandler(config))
+	r.HandleFunc("/dust/spend", SpendDustHandler(config))
+	r.HandleFunc("/dust/abandon", AbandonDustHandler(config))
+	r.HandleFunc("/freeze", FreezeHandler(config))
+	r.HandleFunc("/unfreeze", UnfreezeHandler(config))
+	r.HandleFunc("/frozen", FrozenHandler(config))
+	r.HandleFunc("/freeze/history", FreezeHistoryHandler(config))
+	r.HandleFunc("/reconcile", ReconcileHandler(config))
+	r.HandleFunc("/discover", DiscoverHandler(config))
 	r.HandleFunc("/getBalance", GetBalanceHandler(config))
 	r.HandleFunc("/prepareTrezorSign", PrepareTrezorSignHandler(config))
 	r.HandleFunc("/sendSignedTx", SendSignedTxHandler(config))
@@ -126,16 +207,38 @@ func main() {
 	r.HandleFunc("/prepareOmniTrezorSign", PrepareOmniTrezorSignHandler(config))
 	r.HandleFunc("/getOmniBalance", GetOmniBalanceHandler(config))
 	r.HandleFunc("/checkAddr", CheckAddrHandler(config))
+	r.HandleFunc("/lookupAddress", LookupAddressHandler(config))
 
 	r.HandleFunc("/dumpUtxo", DumpUtxoHandler(config))
+	r.HandleFunc("/reservations", ListReservationsHandler(config))
+	r.HandleFunc("/releaseReservation", ReleaseReservationHandler(config))
+	r.HandleFunc("/withdrawal", EnqueueWithdrawalHandler(config))
+	r.HandleFunc("/withdrawal/{id}", GetWithdrawalHandler(config))
+	r.HandleFunc("/tx/{hash}", TxStatusHandler(config))
+	r.HandleFunc("/reverted", RevertedTxsHandler(config))
+	r.HandleFunc("/reverted/clear", ClearRevertedHandler(config))
 
 	r.NotFoundHandler = http.HandlerFunc(NotFoundHandler)
 	log.Println("last block: ", last_id)
 
 	ch1 := make(chan NotifyMessage, 1024)
 	ch2 := make(chan ObjMessage, 1024)
-	go Notifier(config, ch1)
-	go Listener(config, ch2, ch1, last_id)
+	notifierDone := make(chan struct{})
+	go Notifier(config, ch1, notifierDone)
+	// resume the deliveries in flight when we stopped last time
+	requeueDeliveries(ch1, false)
+	listenerDone := make(chan struct{})
+	go Listener(config, ch2, ch1, last_id, listenerDone)
+	if config.GapLimit > 0 {
+		go func() {
+			report, err := discoverAddresses(config, config.GapLimit, config.DiscoverFrom)
+			if err != nil {
+				log.Println("discover address err:", err)
+				return
+			}
+			printDiscoveryReport(report)
+		}()
+	}
 
 	host := ":" + strconv.FormatInt(int64(config.Port), 10)
 	log.Printf("Starting web server at %s ...\n", host)
@@ -152,6 +255,35 @@ func main() {
 	}
 	go server.Serve(listener)
 
+	zmqQuit := make(chan struct{})
+	zmqDone := make(chan struct{})
+	if config.ZmqURL != "" {
+		go ZmqSubscriber(config, ch2, zmqQuit, zmqDone)
+	} else {
+		close(zmqDone)
+	}
+
+	withdrawQuit := make(chan struct{})
+	withdrawDone := make(chan struct{})
+	go WithdrawalScheduler(config, withdrawQuit, withdrawDone)
+	monitorQuit := make(chan struct{})
+	monitorDone := make(chan struct{})
+	go BroadcastMonitor(config, monitorQuit, monitorDone)
+	sweepQuit := make(chan struct{})
+	sweepDone := make(chan struct{})
+	if config.SweepEnable {
+		go SweepScheduler(config, sweepQuit, sweepDone)
+	} else {
+		close(sweepDone)
+	}
+	consolidateQuit := make(chan struct{})
+	consolidateDone := make(chan struct{})
+	if config.ConsolidateEnable {
+		go ConsolidationScheduler(config, consolidateQuit, consolidateDone)
+	} else {
+		close(consolidateDone)
+	}
+
 	//launch the signal once avoiding waiting for a long time
 	GetNewerBlock(config, ch2)
 
@@ -169,6 +301,7 @@ func main() {
 		case <-newBlockTicker.C:
 			conf.SaveConfiguration(config, fConfigFile)
 			GetNewerBlock(config, ch2)
+			requeueDeliveries(ch1, true)
 		}
 
 		if stop == 1 {
@@ -176,7 +309,25 @@ func main() {
 		}
 	}
 
+	close(zmqQuit)
+	<-zmqDone
+	close(withdrawQuit)
+	<-withdrawDone
+	close(monitorQuit)
+	<-monitorDone
+	close(sweepQuit)
+	<-sweepDone
+	close(consolidateQuit)
+	<-consolidateDone
 	server.Close()
+	// zmq and the loop above were the only senders of new blocks, and the
+	// listener the only one of messages, drain both before closing the db
+	close(ch2)
+	<-listenerDone
+	close(ch1)
+	<-notifierDone
+	// wait for a handler or discovery still holding m, and keep them out
+	m.Lock()
 	closeDb()
 	conf.SaveConfiguration(config, fConfigFile)
 	log.Println("bye")
@@ -37,6 +37,10 @@ type Utxo struct {
 	Index   uint32
 	Address string
 	Value   int64
+	Height  uint64
+	Script  []byte
+	Path    string
+	Frozen  bool
 }
 
 type TrezorInput struct {
@@ -97,6 +101,15 @@ func getScriptFromAddress(address string, param *chaincfg.Params) ([]byte, error
 	return script, nil
 }
 
+// scriptForAddress builds the output script of a wallet address, cash
+// addresses are accepted on bch.
+func scriptForAddress(address string, param *chaincfg.Params) ([]byte, error) {
+	if strings.HasPrefix(strings.ToLower(param.Name), "bch") {
+		address, _ = util.ConvertCashAddrToLegacy(address, param)
+	}
+	return getScriptFromAddress(address, param)
+}
+
 func BuildRawMsgTx(param *chaincfg.Params, inputs []TxInput, outputs []TxOut) (*wire.MsgTx, error) {
 	tx := wire.NewMsgTx(wire.TxVersion)
 
@@ -135,6 +148,12 @@ func BuildSignedMsgTx(chain, xpriv string, inputs []TxInput, outputs []TxOut) (*
 }
 
 func SignMsgTx(chain, xpriv string, tx *wire.MsgTx) (*wire.MsgTx, error) {
+	return signMsgTx(chain, xpriv, tx, GetUtxoByKey, false)
+}
+
+// signMsgTx signs the tx, lookup returns the output spent by an input. Only
+// inner addresses are spent unless anyBranch is set.
+func signMsgTx(chain, xpriv string, tx *wire.MsgTx, lookup func(string, uint32) (*TxOut, error), anyBranch bool) (*wire.MsgTx, error) {
 	signedTx := tx.Copy()
 	param := util.GetParamByName(chain)
 	onBCH := false
@@ -155,14 +174,14 @@ func SignMsgTx(chain, xpriv string, tx *wire.MsgTx) (*wire.MsgTx, error) {
 
 	for i := 0; i < len(signedTx.TxIn); i++ {
 		outPoint := tx.TxIn[i].PreviousOutPoint
-		out, err := GetUtxoByKey(outPoint.Hash.String(), outPoint.Index)
+		out, err := lookup(outPoint.Hash.String(), outPoint.Index)
 		if err != nil {
 			log.Println("get utxo err:", err)
 			return nil, err
 		}
 
 		address := out.Address
-		val, ok := util.LoadAddrPath(address)
+		path, ok := util.LoadAddrPath(address)
 		if !ok {
 			log.Println("utxo not fround in wallet")
 			return nil, errors.New("Unspendable utxo found")
@@ -176,14 +195,11 @@ func SignMsgTx(chain, xpriv string, tx *wire.MsgTx) (*wire.MsgTx, error) {
 			return nil, err
 		}
 
-		pos := strings.IndexByte(val, '/')
-		branch, _ := strconv.ParseInt(val[0:pos], 10, 32)
-		addrId, _ := strconv.ParseInt(val[pos+1:], 10, 32)
-		if branch != 1 {
+		if path.Branch != util.BRANCH_INTERNAL && !anyBranch {
 			log.Println("input must only come from inner address")
 			return nil, errors.New("invalid input")
 		}
-		privKey, _ := util.GetPrivateKey(xpriv, int(branch), int(addrId))
+		privKey, _ := util.GetPrivateKey(xpriv, int(path.Branch), int(path.Index))
 		//log.Println("privkey:", hex.EncodeToString(privKey.ToECDSA().D.Bytes()))
 		if onBCH {
 			signedTx.TxIn[i].SignatureScript, err = bchtxscript.SignatureScript(
@@ -276,16 +292,13 @@ func PrepareTrezorSign(config *conf.Config, tx *wire.MsgTx) (string, error) {
 			return "", err
 		}
 
-		val, _ := util.LoadAddrPath(out.Address)
-		pos := strings.IndexByte(val, '/')
-		branch, _ := strconv.ParseInt(val[0:pos], 10, 32)
-		addrId, _ := strconv.ParseInt(val[pos+1:], 10, 32)
+		path, _ := util.LoadAddrPath(out.Address)
 
 		trezorTx.Inputs[i].AddressN[0] = 44 | 0x80000000
 		trezorTx.Inputs[i].AddressN[1] = param.HDCoinType | 0x80000000
 		trezorTx.Inputs[i].AddressN[2] = 0 | 0x80000000 //account 0
-		trezorTx.Inputs[i].AddressN[3] = uint32(branch)
-		trezorTx.Inputs[i].AddressN[4] = uint32(addrId)
+		trezorTx.Inputs[i].AddressN[3] = path.Branch
+		trezorTx.Inputs[i].AddressN[4] = path.Index
 		trezorTx.Inputs[i].PrevIndex = int(prevIndex)
 		trezorTx.Inputs[i].PrevHash = prevHash
 		trezorTx.Inputs[i].Amount = strconv.FormatInt(out.Amount, 10)
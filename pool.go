@@ -0,0 +1,315 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	conf "github.com/bytefly/dashcash-wallet/config"
+	"log"
+	"math/big"
+	"time"
+
+	badger "github.com/dgraph-io/badger"
+)
+
+const (
+	DELIVERY_PENDING = iota
+	DELIVERY_DELIVERED
+	DELIVERY_FAILED
+	// its block was orphaned before it was delivered
+	DELIVERY_REVERTED
+
+	// give up a notification after so many failed attempts
+	MAX_DELIVERY_ATTEMPTS = 10
+
+	POOL_KEY_PREFIX     = "pool/"
+	DELIVERY_KEY_PREFIX = "delivery/"
+	// reverted/<hash>/<coin>/<type>/<address> keeps the delivered txs
+	// orphaned by a reorg until they are mined again or cleared
+	REVERTED_KEY_PREFIX = "reverted/"
+)
+
+// Delivery tracks a wallet transaction notification until both the freezing
+// system and the fund flow have accepted it.
+type Delivery struct {
+	Message  NotifyMessage
+	State    int
+	Tars     bool
+	FundFlow bool
+	Attempts int
+	Updated  int64
+}
+
+// RevertedTx is a delivered tx whose block was orphaned. The freezing system
+// and the fund flow have no revert entry, so it waits for the operators.
+type RevertedTx struct {
+	Message  NotifyMessage
+	Reverted int64
+}
+
+func messageKey(prefix string, message NotifyMessage) []byte {
+	return []byte(fmt.Sprintf("%s%s/%s/%d/%s", prefix, message.TxHash, message.Coin, message.TxType, message.Address))
+}
+
+func deliveryKey(message NotifyMessage) []byte {
+	return messageKey(DELIVERY_KEY_PREFIX, message)
+}
+
+func getDelivery(message NotifyMessage) (*Delivery, error) {
+	d := new(Delivery)
+	err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(deliveryKey(message))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(v []byte) error {
+			return json.Unmarshal(v, d)
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func saveDelivery(d *Delivery) error {
+	d.Updated = time.Now().Unix()
+	buf, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+
+	return db.Update(func(txn *badger.Txn) error {
+		return txn.Set(deliveryKey(d.Message), buf)
+	})
+}
+
+// queueNotify records a pending delivery for the message and hands it to the
+// Notifier, unless it has already been handled before.
+func queueNotify(ch chan<- NotifyMessage, message NotifyMessage) {
+	if message.MessageType == NOTIFY_TYPE_TX && !message.Reverted {
+		d, err := getDelivery(message)
+		if err == nil && d.State == DELIVERY_REVERTED {
+			// mined again in another block
+			err = saveDelivery(&Delivery{Message: message, State: DELIVERY_PENDING})
+		} else if err == nil && d.State != DELIVERY_PENDING {
+			if clearRevertedTx(message) {
+				log.Println("reverted tx mined again:", message.TxHash, message.Address)
+			} else {
+				log.Println("tx already notified:", message.TxHash, message.Address)
+			}
+			return
+		} else if err == badger.ErrKeyNotFound {
+			err = saveDelivery(&Delivery{Message: message, State: DELIVERY_PENDING})
+		}
+		if err != nil {
+			log.Println("save delivery err:", err, message.TxHash)
+		}
+	}
+
+	ch <- message
+}
+
+// saveRevertedTx records a delivered tx reverted by a reorg.
+func saveRevertedTx(message NotifyMessage) error {
+	message.Reverted = false
+	buf, err := json.Marshal(&RevertedTx{Message: message, Reverted: time.Now().Unix()})
+	if err != nil {
+		return err
+	}
+
+	return db.Update(func(txn *badger.Txn) error {
+		return txn.Set(messageKey(REVERTED_KEY_PREFIX, message), buf)
+	})
+}
+
+// clearRevertedTx drops the reverted record of the message, telling whether
+// there was one.
+func clearRevertedTx(message NotifyMessage) bool {
+	found := false
+	err := db.Update(func(txn *badger.Txn) error {
+		key := messageKey(REVERTED_KEY_PREFIX, message)
+		if _, err := txn.Get(key); err != nil {
+			return err
+		}
+		found = true
+		return txn.Delete(key)
+	})
+	if err != nil && err != badger.ErrKeyNotFound {
+		log.Println("clear reverted tx err:", err, message.TxHash)
+	}
+	return found
+}
+
+// revertedTxs returns the reverted txs, all of them when hash is empty.
+func revertedTxs(hash string) ([]RevertedTx, error) {
+	txs := make([]RevertedTx, 0)
+	err := db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(REVERTED_KEY_PREFIX)
+		if hash != "" {
+			opts.Prefix = []byte(REVERTED_KEY_PREFIX + hash + "/")
+		}
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			var t RevertedTx
+			err := it.Item().Value(func(v []byte) error {
+				return json.Unmarshal(v, &t)
+			})
+			if err != nil {
+				return err
+			}
+			txs = append(txs, t)
+		}
+		return nil
+	})
+	return txs, err
+}
+
+// clearRevertedTxs drops the reverted records of the tx once the operators
+// have settled them, returning how many there were.
+func clearRevertedTxs(hash string) (int, error) {
+	txs, err := revertedTxs(hash)
+	if err != nil {
+		return 0, err
+	}
+	err = db.Update(func(txn *badger.Txn) error {
+		for _, t := range txs {
+			if err := txn.Delete(messageKey(REVERTED_KEY_PREFIX, t.Message)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return len(txs), err
+}
+
+// requeueDeliveries sends the pending deliveries to the Notifier again. When
+// retriedOnly is set the ones never attempted are left alone.
+func requeueDeliveries(ch chan<- NotifyMessage, retriedOnly bool) {
+	deliveries := make([]*Delivery, 0)
+	db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		prefix := []byte(DELIVERY_KEY_PREFIX)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			it.Item().Value(func(v []byte) error {
+				d := new(Delivery)
+				if err := json.Unmarshal(v, d); err != nil {
+					return err
+				}
+				if d.State == DELIVERY_PENDING && (!retriedOnly || d.Attempts > 0) {
+					deliveries = append(deliveries, d)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+
+	for _, d := range deliveries {
+		ch <- d.Message
+	}
+	if len(deliveries) > 0 {
+		log.Println("requeue pending deliveries:", len(deliveries))
+	}
+}
+
+// savePoolBlock keeps the txs of a block until it gets enough confirmations.
+func savePoolBlock(height uint64, messages []NotifyMessage) error {
+	buf, err := json.Marshal(messages)
+	if err != nil {
+		return err
+	}
+
+	return db.Update(func(txn *badger.Txn) error {
+		return txn.Set(heightKey(POOL_KEY_PREFIX, height), buf)
+	})
+}
+
+// addPoolMessages adds the messages to the pooled txs of the block.
+func addPoolMessages(height uint64, messages []NotifyMessage) error {
+	return db.Update(func(txn *badger.Txn) error {
+		pooled := make([]NotifyMessage, 0)
+		item, err := txn.Get(heightKey(POOL_KEY_PREFIX, height))
+		if err == nil {
+			err = item.Value(func(v []byte) error {
+				return json.Unmarshal(v, &pooled)
+			})
+		}
+		if err != nil && err != badger.ErrKeyNotFound {
+			return err
+		}
+
+		buf, err := json.Marshal(append(pooled, messages...))
+		if err != nil {
+			return err
+		}
+		return txn.Set(heightKey(POOL_KEY_PREFIX, height), buf)
+	})
+}
+
+func deletePoolBlock(height uint64) error {
+	return db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(heightKey(POOL_KEY_PREFIX, height))
+	})
+}
+
+// releasePool notifies the pooled txs having enough confirmations at the tip
+// and keeps the others in the pool.
+func releasePool(config *conf.Config, tip uint64, ch chan<- NotifyMessage) {
+	heights := make([]uint64, 0)
+	blocks := make([][]NotifyMessage, 0)
+	db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		prefix := []byte(POOL_KEY_PREFIX)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			h := binary.BigEndian.Uint64(item.Key()[len(prefix):])
+			if h > tip {
+				break
+			}
+			item.Value(func(v []byte) error {
+				var messages []NotifyMessage
+				if err := json.Unmarshal(v, &messages); err != nil {
+					log.Println("invalid pool block:", h, err)
+					return err
+				}
+				heights = append(heights, h)
+				blocks = append(blocks, messages)
+				return nil
+			})
+		}
+		return nil
+	})
+
+	for i, h := range heights {
+		remain := make([]NotifyMessage, 0)
+		for _, message := range blocks[i] {
+			if tip-h+1 >= requiredConfirmations(config, message) {
+				queueNotify(ch, message)
+			} else {
+				remain = append(remain, message)
+			}
+		}
+
+		if len(remain) == len(blocks[i]) {
+			continue
+		} else if len(remain) > 0 {
+			savePoolBlock(h, remain)
+			continue
+		}
+
+		ch <- NotifyMessage{
+			MessageType: NOTIFY_TYPE_ADMIN,
+			Amount:      new(big.Int).SetUint64(h),
+		}
+
+		deletePoolBlock(h)
+		log.Println("delete txs in block", h)
+	}
+}
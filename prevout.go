@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/wire"
+
+	badger "github.com/dgraph-io/badger"
+)
+
+// Prevout is the output spent by a tx input.
+type Prevout struct {
+	Value  int64
+	Script []byte
+}
+
+// PrevoutStats counts where the prevouts of the inputs were found.
+type PrevoutStats struct {
+	Inputs int
+	// outputs of earlier txs of the same block
+	BlockHits int
+	// our own utxos, spent by mempool txs too
+	StoreHits int
+	// prevouts given with the block, or outputs of a tx already fetched
+	FetchedHits int
+	// GetRawTransaction calls
+	RPCCalls int
+}
+
+func (s *PrevoutStats) add(o *PrevoutStats) {
+	s.Inputs += o.Inputs
+	s.BlockHits += o.BlockHits
+	s.StoreHits += o.StoreHits
+	s.FetchedHits += o.FetchedHits
+	s.RPCCalls += o.RPCCalls
+}
+
+// PrevoutCache resolves the outputs spent by the inputs of a block, asking
+// the node only for those it cannot find in the block, in our utxo set or in
+// the prevouts fetched with the block.
+type PrevoutCache struct {
+	client  *rpcclient.Client
+	block   map[string]Prevout
+	fetched map[string]Prevout
+	Stats   PrevoutStats
+}
+
+// newPrevoutCache indexes the outputs of the block. The prevouts may come
+// from getblock verbosity 3, nil when the node does not give them.
+func newPrevoutCache(client *rpcclient.Client, block *wire.MsgBlock, prevouts map[string]Prevout) *PrevoutCache {
+	c := &PrevoutCache{
+		client:  client,
+		block:   make(map[string]Prevout),
+		fetched: prevouts,
+	}
+	if c.fetched == nil {
+		c.fetched = make(map[string]Prevout)
+	}
+	if block != nil {
+		for _, tx := range block.Transactions {
+			hash := tx.TxHash().String()
+			for i, out := range tx.TxOut {
+				c.block[outpointKey(hash, uint32(i))] = Prevout{Value: out.Value, Script: out.PkScript}
+			}
+		}
+	}
+	return c
+}
+
+func (c *PrevoutCache) lookup(hash *chainhash.Hash, index uint32) (*Prevout, error) {
+	c.Stats.Inputs++
+	key := outpointKey(hash.String(), index)
+	if p, ok := c.block[key]; ok {
+		c.Stats.BlockHits++
+		return &p, nil
+	}
+	if p, ok := c.fetched[key]; ok {
+		c.Stats.FetchedHits++
+		return &p, nil
+	}
+
+	var p *Prevout
+	db.View(func(txn *badger.Txn) error {
+		u, err := getUtxo(txn, hash.String(), index)
+		if err == badger.ErrKeyNotFound {
+			u, err = getMempoolSpent(txn, hash.String(), index)
+		}
+		if err == nil {
+			p = &Prevout{Value: u.Value, Script: u.Script}
+		}
+		return nil
+	})
+	if p != nil && len(p.Script) > 0 {
+		c.Stats.StoreHits++
+		return p, nil
+	}
+
+	c.Stats.RPCCalls++
+	tx, err := c.client.GetRawTransaction(hash)
+	if err != nil {
+		return nil, err
+	}
+	outs := tx.MsgTx().TxOut
+	if int(index) >= len(outs) {
+		return nil, fmt.Errorf("tx %s has no output %d", hash, index)
+	}
+	// the other outputs of the tx may be spent in the same block
+	for i, out := range outs {
+		c.fetched[outpointKey(hash.String(), uint32(i))] = Prevout{Value: out.Value, Script: out.PkScript}
+	}
+	return &Prevout{Value: outs[index].Value, Script: outs[index].PkScript}, nil
+}
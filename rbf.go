@@ -0,0 +1,267 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	conf "github.com/bytefly/dashcash-wallet/config"
+	"github.com/bytefly/dashcash-wallet/util"
+	"log"
+	"strings"
+
+	badger "github.com/dgraph-io/badger"
+)
+
+// inputs with a lower sequence signal replace-by-fee (BIP125)
+const RBF_SEQUENCE = wire.MaxTxInSequenceNum - 2
+
+func rbfEnabled(config *conf.Config) bool {
+	return config.EnableRBF && strings.HasPrefix(strings.ToLower(config.ChainName), "btc")
+}
+
+func signalRBF(tx *wire.MsgTx) {
+	for _, in := range tx.TxIn {
+		in.Sequence = RBF_SEQUENCE
+	}
+}
+
+func signalsRBF(tx *wire.MsgTx) bool {
+	for _, in := range tx.TxIn {
+		if in.Sequence < wire.MaxTxInSequenceNum-1 {
+			return true
+		}
+	}
+	return false
+}
+
+// isWalletScript tells whether the output pays one of our addresses.
+func isWalletScript(script []byte, config *conf.Config) bool {
+	param := util.GetParamByName(config.ChainName)
+	_, addrSet, _, err := txscript.ExtractPkScriptAddrs(script, param)
+	if err != nil || len(addrSet) == 0 {
+		return false
+	}
+	_, ok := util.LoadAddrPath(addrSet[0].EncodeAddress())
+	return ok
+}
+
+// bumpFee replaces the unconfirmed wallet tx txid by one paying the same
+// outputs at feeRate, taking the fee from the change and adding inputs when
+// the change is too small. The caller holds m.
+func bumpFee(config *conf.Config, txid string, feeRate uint32, selector CoinSelector) (*SentTx, error) {
+	orig, err := getSentTx(txid)
+	if err != nil {
+		return nil, errors.New("tx not sent by this wallet")
+	}
+	if orig.ReplacedBy != "" {
+		return nil, fmt.Errorf("tx already replaced by %s", orig.ReplacedBy)
+	}
+	if len(orig.Inputs) == 0 {
+		return nil, errors.New("inputs of the tx are unknown")
+	}
+	origTx, err := orig.MsgTx()
+	if err != nil {
+		return nil, err
+	}
+	if !signalsRBF(origTx) {
+		return nil, errors.New("tx does not signal replace-by-fee")
+	}
+
+	client, err := ConnectRPC(config)
+	if err != nil {
+		return nil, err
+	}
+	_, err = client.GetMempoolEntry(txid)
+	client.Shutdown()
+	if err != nil {
+		return nil, errors.New("tx is not in the mempool")
+	}
+
+	signedTx, replacement, err := buildReplacement(config, orig, origTx, feeRate, selector)
+	if err != nil {
+		return nil, err
+	}
+	// move the requests of a batch before the replacement can be mined
+	batch := replaceBatch(txid, replacement)
+
+	hash, err := SendTransaction(config, signedTx)
+	if err != nil {
+		if batch != nil {
+			deleteBatch(replacement.Hash)
+		}
+		return nil, fmt.Errorf("send tx err:%v", err)
+	}
+	log.Println("replace tx", txid, "by", hash, "fee:", orig.Fee, "->", replacement.Fee)
+	if err = saveSentTx(replacement); err != nil {
+		log.Println("save sent tx err:", err, hash)
+	}
+	orig.ReplacedBy = hash
+	orig.Status = SENT_REPLACED
+	if err = saveSentTx(orig); err != nil {
+		log.Println("save sent tx err:", err, txid)
+	}
+
+	// the outputs of the original are gone with it
+	for i := range origTx.TxOut {
+		removeUtxo(txid, uint32(i))
+	}
+	if err = ParseMempoolTransaction(config, signedTx, config.ChainName); err != nil {
+		log.Println("parse signed tx error:", err)
+	}
+	for _, o := range batch {
+		if o.Withdrawal == 0 {
+			continue
+		}
+		w, err := getWithdrawal(o.Withdrawal)
+		if err != nil {
+			log.Println("get withdrawal err:", err, o.Withdrawal)
+			continue
+		}
+		w.TxHash = hash
+		w.Fee = o.Fee
+		if err = saveWithdrawal(w); err != nil {
+			log.Println("save withdrawal err:", err, w.Id)
+		}
+	}
+	return replacement, nil
+}
+
+// buildReplacement signs a tx paying the outputs of orig at feeRate. The
+// inputs of a sweep come from any branch, those of other txs from the inner
+// addresses only.
+func buildReplacement(config *conf.Config, orig *SentTx, origTx *wire.MsgTx, feeRate uint32, selector CoinSelector) (*wire.MsgTx, *SentTx, error) {
+	param := util.GetParamByName(config.ChainName)
+	tx := wire.NewMsgTx(origTx.Version)
+	tx.LockTime = origTx.LockTime
+	spent := make(map[string]*TxOut)
+	scripts := make([][]byte, 0)
+	var balance, amount int64
+	for _, u := range orig.Inputs {
+		hash, _ := chainhash.NewHashFromStr(u.Hash)
+		in := wire.NewTxIn(wire.NewOutPoint(hash, u.Index), nil, nil)
+		in.Sequence = RBF_SEQUENCE
+		tx.AddTxIn(in)
+		scripts = append(scripts, u.Script)
+		spent[outpointKey(u.Hash, u.Index)] = &TxOut{Address: u.Address, Amount: u.Value, Script: u.Script}
+		balance += u.Value
+	}
+
+	// keep the payments in place, the change goes last again
+	var changeScript []byte
+	for i, out := range origTx.TxOut {
+		if !isWalletScript(out.PkScript, config) {
+			tx.AddTxOut(wire.NewTxOut(out.Value, out.PkScript))
+			amount += out.Value
+			continue
+		}
+		// a tx spending our change would be evicted with the original
+		err := db.View(func(txn *badger.Txn) error {
+			_, err := getUtxo(txn, orig.Hash, uint32(i))
+			return err
+		})
+		if err != nil {
+			return nil, nil, errors.New("outputs of the tx are spent by other txs")
+		}
+		changeScript = out.PkScript
+	}
+	if len(changeScript) == 0 {
+		var err error
+		changeScript, err = scriptForAddress(orig.Inputs[0].Address, param)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// pay the new rate, and at least the original fee plus the relay fee of
+	// the replacement (BIP125 rules 3 and 4)
+	feeFor := func(vsize int64) int64 {
+		fee := txFee(feeRate, vsize)
+		if min := orig.Fee + txFee(MIN_FEE_PER_KB, vsize); fee < min {
+			fee = min
+		}
+		return fee
+	}
+	minAmount := minOutputAmount(feeRate)
+
+	added := make([]Utxo, 0)
+	withChange := feeFor(estimateVSize(tx, scripts, changeScript))
+	if balance < amount+withChange+minAmount && balance < amount+feeFor(estimateVSize(tx, scripts)) {
+		utxos, err := GetAllUtxoByBranch(1, false)
+		if err != nil {
+			return nil, nil, err
+		}
+		utxos, err = filterReserved(utxos)
+		if err != nil {
+			return nil, nil, err
+		}
+		candidates := make([]Utxo, 0)
+		for _, u := range utxos {
+			// a replacement must not spend new unconfirmed outputs (BIP125 rule 2)
+			if u.Height == 0 || u.Hash == orig.Hash {
+				continue
+			}
+			candidates = append(candidates, u)
+		}
+
+		params := &SelectionParams{
+			Target:     amount + feeFor(estimateVSize(tx, scripts)) - balance,
+			ChangeCost: withChange - feeFor(estimateVSize(tx, scripts)),
+			MinChange:  minAmount,
+			FeePerKb:   feeRate,
+		}
+		added, err = selector.Select(candidates, params)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, u := range added {
+			hash, _ := chainhash.NewHashFromStr(u.Hash)
+			in := wire.NewTxIn(wire.NewOutPoint(hash, u.Index), nil, nil)
+			in.Sequence = RBF_SEQUENCE
+			tx.AddTxIn(in)
+			scripts = append(scripts, u.Script)
+			spent[outpointKey(u.Hash, u.Index)] = &TxOut{Address: u.Address, Amount: u.Value, Script: u.Script}
+			balance += u.Value
+		}
+	}
+
+	fee := feeFor(estimateVSize(tx, scripts, changeScript))
+	if balance-(amount+fee) >= minAmount {
+		tx.AddTxOut(wire.NewTxOut(balance-(amount+fee), changeScript))
+	} else {
+		fee = feeFor(estimateVSize(tx, scripts))
+		if balance < amount+fee {
+			return nil, nil, errors.New("utxo out of balance")
+		}
+	}
+
+	signedTx, err := signMsgTx(config.ChainName, config.Xpriv, tx, func(hash string, index uint32) (*TxOut, error) {
+		if out, ok := spent[outpointKey(hash, index)]; ok {
+			return out, nil
+		}
+		return nil, badger.ErrKeyNotFound
+	}, orig.Sweep)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	replacement := newSentTx(signedTx, append(append([]Utxo(nil), orig.Inputs...), added...), feeRate)
+	replacement.Replaces = orig.Hash
+	replacement.Sweep = orig.Sweep
+	return signedTx, replacement, nil
+}
+
+// replaceBatch copies the requests paid by a batch tx to its replacement
+// and returns them, nil when txid is not a batch.
+func replaceBatch(txid string, replacement *SentTx) []BatchOutput {
+	batch, err := getBatch(txid)
+	if err != nil {
+		return nil
+	}
+	splitBatchFee(batch, replacement.Fee)
+	if err = saveBatch(replacement.Hash, batch); err != nil {
+		log.Println("save batch err:", err, replacement.Hash)
+	}
+	return batch
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil/hdkeychain"
+	conf "github.com/bytefly/dashcash-wallet/config"
+	"github.com/bytefly/dashcash-wallet/util"
+	"testing"
+)
+
+func TestBuildReplacementOfSweep(t *testing.T) {
+	if err := openDb(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer closeDb()
+
+	master, err := hdkeychain.NewMaster(make([]byte, 32), &chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xpub, err := master.Neuter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &conf.Config{ChainName: "btc", Xpriv: master.String()}
+	param := util.GetParamByName(config.ChainName)
+
+	scriptAt := func(path util.AddrPath) (string, []byte) {
+		addr, err := util.DeriveAddress(xpub.String(), path, param)
+		if err != nil {
+			t.Fatal(err)
+		}
+		util.StoreAddrPath(addr, path)
+		script, err := scriptForAddress(addr, param)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return addr, script
+	}
+	depositAddr, depositScript := scriptAt(util.AddrPath{Branch: util.BRANCH_EXTERNAL, Index: 0})
+	innerAddr, innerScript := scriptAt(util.AddrPath{Branch: util.BRANCH_INTERNAL, Index: 0})
+
+	// a sweep of a deposit into an inner address, the whole value is change
+	depositHash := chainhash.Hash{1}
+	deposit := Utxo{Hash: depositHash.String(), Index: 1, Address: depositAddr, Value: 100000, Height: 10, Script: depositScript, Path: "0/0"}
+	origTx := wire.NewMsgTx(wire.TxVersion)
+	in := wire.NewTxIn(wire.NewOutPoint(&depositHash, deposit.Index), nil, nil)
+	in.Sequence = RBF_SEQUENCE
+	origTx.AddTxIn(in)
+	origTx.AddTxOut(wire.NewTxOut(99000, innerScript))
+	orig := &SentTx{Hash: origTx.TxHash().String(), Inputs: []Utxo{deposit}, Fee: 1000, Sweep: true}
+	if err = createUtxo(Utxo{Hash: orig.Hash, Index: 0, Address: innerAddr, Value: 99000, Script: innerScript}); err != nil {
+		t.Fatal(err)
+	}
+
+	signedTx, replacement, err := buildReplacement(config, orig, origTx, 20000, largestFirstSelector{})
+	if err != nil {
+		t.Fatal("bump sweep:", err)
+	}
+	if !replacement.Sweep || replacement.Replaces != orig.Hash {
+		t.Fatalf("replacement %+v", replacement)
+	}
+	if len(signedTx.TxIn) != 1 || len(signedTx.TxOut) != 1 || signedTx.TxOut[0].Value >= 99000 {
+		t.Fatalf("replacement pays %d in %d outputs", signedTx.TxOut[0].Value, len(signedTx.TxOut))
+	}
+	if replacement.Fee <= orig.Fee || replacement.Fee != deposit.Value-signedTx.TxOut[0].Value {
+		t.Fatalf("replacement fee %d", replacement.Fee)
+	}
+	vm, err := txscript.NewEngine(depositScript, signedTx, 0, txscript.StandardVerifyFlags, nil, nil, deposit.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = vm.Execute(); err != nil {
+		t.Fatal("signature of the deposit input:", err)
+	}
+
+	// other txs only spend inner addresses
+	orig.Sweep = false
+	if _, _, err = buildReplacement(config, orig, origTx, 20000, largestFirstSelector{}); err == nil {
+		t.Fatal("deposit input signed for a withdrawal")
+	}
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/rpcclient"
+	conf "github.com/bytefly/dashcash-wallet/config"
+	"github.com/bytefly/dashcash-wallet/util"
+	"log"
+	"math"
+	"strings"
+	"time"
+
+	badger "github.com/dgraph-io/badger"
+)
+
+const (
+	// stored but unknown to the node, spent or never mined
+	RECONCILE_STALE = "stale"
+	// unspent on the node but not stored
+	RECONCILE_MISSING = "missing"
+	// stored with another value or confirmation state
+	RECONCILE_MISMATCH = "mismatch"
+)
+
+// ReconcileDiff is a difference between the utxo db and the node. Utxo is
+// what the node knows, the stored record for a stale utxo.
+type ReconcileDiff struct {
+	Kind   string
+	Utxo   Utxo
+	Detail string
+	Fixed  bool
+}
+
+type ReconcileReport struct {
+	Time int64
+	// "scantxoutset", or "rescan" from the height From
+	Method    string
+	From      int64
+	Checked   int
+	Addresses int
+	Diffs     []ReconcileDiff
+}
+
+type scanTxOutResult struct {
+	Success  bool `json:"success"`
+	Unspents []struct {
+		TxId         string  `json:"txid"`
+		Vout         uint32  `json:"vout"`
+		ScriptPubKey string  `json:"scriptPubKey"`
+		Amount       float64 `json:"amount"`
+		Height       int64   `json:"height"`
+	} `json:"unspents"`
+}
+
+func toSatoshi(amount float64) int64 {
+	return int64(math.Round(amount * 1e8))
+}
+
+// checkStoredUtxos looks up every stored utxo on the node, mempool included
+// as ParseMempoolTransaction keeps the db in line with it.
+func checkStoredUtxos(client *rpcclient.Client, report *ReconcileReport) error {
+	tip, err := client.GetBlockCount()
+	if err != nil {
+		return err
+	}
+
+	stored := make([]Utxo, 0)
+	err = iterateUtxo([]byte(UTXO_KEY_PREFIX), func(u *Utxo) {
+		stored = append(stored, *u)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, u := range stored {
+		hash, _ := chainhash.NewHashFromStr(u.Hash)
+		out, err := client.GetTxOut(hash, u.Index, true)
+		if err != nil {
+			return fmt.Errorf("get txout %s:%d err: %v", u.Hash, u.Index, err)
+		}
+		report.Checked++
+
+		if out == nil {
+			report.Diffs = append(report.Diffs, ReconcileDiff{Kind: RECONCILE_STALE, Utxo: u, Detail: "not in the node utxo set"})
+			continue
+		}
+
+		actual := u
+		actual.Value = toSatoshi(out.Value)
+		actual.Height = 0
+		if out.Confirmations > 0 {
+			actual.Height = uint64(tip - out.Confirmations + 1)
+		}
+		switch {
+		case actual.Value != u.Value:
+			report.Diffs = append(report.Diffs, ReconcileDiff{Kind: RECONCILE_MISMATCH, Utxo: actual, Detail: fmt.Sprintf("stored value %d", u.Value)})
+		case (actual.Height > 0) != (u.Height > 0):
+			report.Diffs = append(report.Diffs, ReconcileDiff{Kind: RECONCILE_MISMATCH, Utxo: actual, Detail: fmt.Sprintf("stored height %d", u.Height)})
+		}
+	}
+	return nil
+}
+
+// scanAddresses finds the confirmed utxos of all our addresses with
+// scantxoutset.
+func scanAddresses(client *rpcclient.Client, config *conf.Config, report *ReconcileReport) ([]Utxo, error) {
+	addrs := make([]string, 0)
+	util.RangeAddrPath(func(addr string, path util.AddrPath) bool {
+		addrs = append(addrs, addr)
+		return true
+	})
+	report.Addresses = len(addrs)
+	return scanTxOutSet(client, config, addrs)
+}
+
+// scanTxOutSet finds the confirmed utxos of the addresses with scantxoutset.
+func scanTxOutSet(client *rpcclient.Client, config *conf.Config, addrs []string) ([]Utxo, error) {
+	if len(addrs) == 0 {
+		return nil, nil
+	}
+	param := util.GetParamByName(config.ChainName)
+	isBch := strings.HasPrefix(strings.ToLower(config.ChainName), "bch")
+	descs := make([]map[string]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if isBch {
+			addr = param.Bech32HRPSegwit + ":" + addr
+		}
+		descs = append(descs, map[string]string{"desc": "addr(" + addr + ")"})
+	}
+
+	params := make([]json.RawMessage, 2)
+	params[0], _ = json.Marshal("start")
+	params[1], _ = json.Marshal(descs)
+	raw, err := client.RawRequest("scantxoutset", params)
+	if err != nil {
+		return nil, fmt.Errorf("scantxoutset err: %v", err)
+	}
+
+	var result scanTxOutResult
+	if err = json.Unmarshal(raw, &result); err != nil {
+		return nil, err
+	}
+	if !result.Success {
+		return nil, fmt.Errorf("scantxoutset failed")
+	}
+
+	utxos := make([]Utxo, 0, len(result.Unspents))
+	for _, unspent := range result.Unspents {
+		script, err := hex.DecodeString(unspent.ScriptPubKey)
+		if err != nil {
+			continue
+		}
+		addr, ok := scriptAddress(config.ChainName, script)
+		if !ok {
+			continue
+		}
+		utxos = append(utxos, Utxo{Hash: unspent.TxId, Index: unspent.Vout, Address: addr, Value: toSatoshi(unspent.Amount), Height: uint64(unspent.Height), Script: script})
+	}
+	// scantxoutset ignores the mempool
+	return filterUnspent(client, utxos)
+}
+
+// filterUnspent drops the utxos spent in the mempool meanwhile.
+func filterUnspent(client *rpcclient.Client, utxos []Utxo) ([]Utxo, error) {
+	unspent := make([]Utxo, 0, len(utxos))
+	for _, u := range utxos {
+		hash, _ := chainhash.NewHashFromStr(u.Hash)
+		out, err := client.GetTxOut(hash, u.Index, true)
+		if err != nil {
+			return nil, fmt.Errorf("get txout %s:%d err: %v", u.Hash, u.Index, err)
+		}
+		if out != nil {
+			unspent = append(unspent, u)
+		}
+	}
+	return unspent, nil
+}
+
+// rescanBlocks finds the utxos of our addresses created from the height on
+// and still unspent at the tip, for nodes without scantxoutset.
+func rescanBlocks(client *rpcclient.Client, config *conf.Config, from int64) ([]Utxo, error) {
+	return scanBlocks(client, from, func(script []byte) (string, bool) {
+		return walletAddress(config.ChainName, script)
+	})
+}
+
+// scanBlocks finds the outputs created from the height on, paying the
+// addresses match accepts, and still unspent at the tip.
+func scanBlocks(client *rpcclient.Client, from int64, match func(script []byte) (string, bool)) ([]Utxo, error) {
+	tip, err := client.GetBlockCount()
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[string]Utxo)
+	for height := from; height <= tip; height++ {
+		hash, err := client.GetBlockHash(height)
+		if err != nil {
+			return nil, fmt.Errorf("read block hash err: %v", err)
+		}
+		block, err := client.GetBlock(hash)
+		if err != nil {
+			return nil, fmt.Errorf("get block err: %v", err)
+		}
+
+		for i, tx := range block.Transactions {
+			//ignore coin base
+			if i == 0 {
+				continue
+			}
+			for _, in := range tx.TxIn {
+				delete(found, outpointKey(in.PreviousOutPoint.Hash.String(), in.PreviousOutPoint.Index))
+			}
+			txHash := tx.TxHash().String()
+			for j, out := range tx.TxOut {
+				if addr, ok := match(out.PkScript); ok {
+					found[outpointKey(txHash, uint32(j))] = Utxo{Hash: txHash, Index: uint32(j), Address: addr, Value: out.Value, Height: uint64(height), Script: out.PkScript}
+				}
+			}
+		}
+	}
+
+	utxos := make([]Utxo, 0, len(found))
+	for _, u := range found {
+		utxos = append(utxos, u)
+	}
+	return filterUnspent(client, utxos)
+}
+
+// reconcileUtxos compares the utxo db with the node, finding the missing
+// utxos by scantxoutset, or by a rescan from the height from when it is
+// above 0. With fix the db is brought in line with the node.
+func reconcileUtxos(config *conf.Config, from int64, fix bool) (*ReconcileReport, error) {
+	client, err := ConnectRPC(config)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Shutdown()
+
+	report := &ReconcileReport{Time: time.Now().Unix(), Method: "scantxoutset", Diffs: make([]ReconcileDiff, 0)}
+	if err = checkStoredUtxos(client, report); err != nil {
+		return nil, err
+	}
+
+	var unspent []Utxo
+	if from > 0 {
+		report.Method = "rescan"
+		report.From = from
+		unspent, err = rescanBlocks(client, config, from)
+	} else {
+		unspent, err = scanAddresses(client, config, report)
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = db.View(func(txn *badger.Txn) error {
+		for _, u := range unspent {
+			_, err := getUtxo(txn, u.Hash, u.Index)
+			if err == badger.ErrKeyNotFound {
+				// spent by a mempool tx of ours, or given up
+				if !isOwnOutpoint(txn, u.Hash, u.Index) && !isAbandoned(txn, u.Hash, u.Index) {
+					report.Diffs = append(report.Diffs, ReconcileDiff{Kind: RECONCILE_MISSING, Utxo: u})
+				}
+			} else if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if fix {
+		fixUtxos(client, report)
+	}
+	return report, nil
+}
+
+// recheckDiff tells whether the diff still holds, since the db and the node
+// may have moved on while the report was built. The caller holds m.
+func recheckDiff(client *rpcclient.Client, d *ReconcileDiff) (bool, error) {
+	var (
+		stored *Utxo
+		own    bool
+	)
+	err := db.View(func(txn *badger.Txn) error {
+		var err error
+		stored, err = getUtxo(txn, d.Utxo.Hash, d.Utxo.Index)
+		if err == badger.ErrKeyNotFound {
+			own = isOwnOutpoint(txn, d.Utxo.Hash, d.Utxo.Index) || isAbandoned(txn, d.Utxo.Hash, d.Utxo.Index)
+			return nil
+		}
+		own = err == nil
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+
+	hash, _ := chainhash.NewHashFromStr(d.Utxo.Hash)
+	out, err := client.GetTxOut(hash, d.Utxo.Index, true)
+	if err != nil {
+		return false, err
+	}
+
+	switch d.Kind {
+	case RECONCILE_STALE:
+		return stored != nil && out == nil, nil
+	case RECONCILE_MISSING:
+		return !own && out != nil, nil
+	case RECONCILE_MISMATCH:
+		return stored != nil && out != nil && toSatoshi(out.Value) == d.Utxo.Value && (out.Confirmations > 0) == (d.Utxo.Height > 0), nil
+	}
+	return false, nil
+}
+
+// fixUtxos applies the diffs of the report still holding to the db.
+func fixUtxos(client *rpcclient.Client, report *ReconcileReport) {
+	m.Lock()
+	defer m.Unlock()
+
+	for i := range report.Diffs {
+		d := &report.Diffs[i]
+		ok, err := recheckDiff(client, d)
+		if err != nil {
+			log.Println("recheck utxo err:", err, d.Kind, d.Utxo.Hash, d.Utxo.Index)
+			continue
+		}
+		if !ok {
+			log.Println("skip", d.Kind, "utxo changed meanwhile:", d.Utxo.Hash, d.Utxo.Index)
+			continue
+		}
+		switch d.Kind {
+		case RECONCILE_STALE:
+			_, err = removeUtxo(d.Utxo.Hash, d.Utxo.Index)
+		case RECONCILE_MISSING:
+			err = createUtxo(d.Utxo)
+		case RECONCILE_MISMATCH:
+			u := d.Utxo
+			u.Frozen = isDust(&u)
+			err = db.Update(func(txn *badger.Txn) error {
+				return putUtxo(txn, &u)
+			})
+		}
+		if err != nil {
+			log.Println("fix utxo err:", err, d.Kind, d.Utxo.Hash, d.Utxo.Index)
+			continue
+		}
+		log.Println("fix", d.Kind, "utxo:", d.Utxo.Hash, d.Utxo.Index, d.Utxo.Address, d.Utxo.Value)
+		d.Fixed = true
+	}
+}
+
+func printReconcileReport(report *ReconcileReport) {
+	log.Println("reconcile by", report.Method, "checked:", report.Checked, "addresses:", report.Addresses, "diffs:", len(report.Diffs))
+	for _, d := range report.Diffs {
+		log.Println(d.Kind, d.Utxo.Hash, d.Utxo.Index, d.Utxo.Address, d.Utxo.Value, d.Utxo.Height, d.Detail, "fixed:", d.Fixed)
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/chaincfg"
+	conf "github.com/bytefly/dashcash-wallet/config"
+	"github.com/bytefly/dashcash-wallet/util"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	badger "github.com/dgraph-io/badger"
+)
+
+const (
+	// address/<address> holds the AddressRecord of an issued address
+	ADDRESS_KEY_PREFIX = "address/"
+	// addrpath/<branch><index> holds the address issued at the path
+	ADDRESS_PATH_KEY_PREFIX = "addrpath/"
+	// meta/addrIndex/<branch> holds the next index to issue on the branch
+	ADDRESS_INDEX_KEY_PREFIX = "meta/addrIndex/"
+	// useraddr/<userId>/<address> indexes the addresses bound to a user
+	USER_ADDRESS_KEY_PREFIX = "useraddr/"
+
+	PURPOSE_DEPOSIT = "deposit"
+	PURPOSE_CHANGE  = "change"
+
+	// records written per transaction when filling the registry
+	ADDRESS_BATCH_SIZE = 1000
+
+	MAX_USER_ID_LEN = 64
+	MAX_LABEL_LEN   = 128
+)
+
+// AddressRecord is an address issued by the wallet.
+type AddressRecord struct {
+	Address string
+	Path    util.AddrPath
+	Created int64
+	UserId  string `json:",omitempty"`
+	Label   string `json:",omitempty"`
+	Purpose string `json:",omitempty"`
+}
+
+func addressKey(address string) []byte {
+	return []byte(ADDRESS_KEY_PREFIX + address)
+}
+
+func addressPathKey(path util.AddrPath) []byte {
+	key := make([]byte, len(ADDRESS_PATH_KEY_PREFIX)+8)
+	copy(key, ADDRESS_PATH_KEY_PREFIX)
+	binary.BigEndian.PutUint32(key[len(ADDRESS_PATH_KEY_PREFIX):], path.Branch)
+	binary.BigEndian.PutUint32(key[len(ADDRESS_PATH_KEY_PREFIX)+4:], path.Index)
+	return key
+}
+
+func userAddressKeyPrefix(userId string) []byte {
+	return []byte(USER_ADDRESS_KEY_PREFIX + userId + "/")
+}
+
+// checkAddressLabel validates the user id and label bound to an address.
+func checkAddressLabel(userId, label string) error {
+	if len(userId) > MAX_USER_ID_LEN || strings.ContainsAny(userId, "/") {
+		return errors.New("invalid user id")
+	}
+	if len(label) > MAX_LABEL_LEN {
+		return errors.New("label too long")
+	}
+	return nil
+}
+
+func addressIndexKey(branch uint32) []byte {
+	return []byte(fmt.Sprintf("%s%d", ADDRESS_INDEX_KEY_PREFIX, branch))
+}
+
+func defaultPurpose(branch uint32) string {
+	if branch == util.BRANCH_EXTERNAL {
+		return PURPOSE_DEPOSIT
+	}
+	return PURPOSE_CHANGE
+}
+
+func getAddressRecord(txn *badger.Txn, address string) (*AddressRecord, error) {
+	item, err := txn.Get(addressKey(address))
+	if err != nil {
+		return nil, err
+	}
+	var rec AddressRecord
+	err = item.Value(func(v []byte) error {
+		return json.Unmarshal(v, &rec)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// nextAddressIndex returns the index the branch issues next.
+func nextAddressIndex(txn *badger.Txn, branch uint32) (uint32, error) {
+	item, err := txn.Get(addressIndexKey(branch))
+	if err == badger.ErrKeyNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var index uint32
+	err = item.Value(func(v []byte) error {
+		if len(v) != 4 {
+			return fmt.Errorf("invalid address index of branch %d", branch)
+		}
+		index = binary.BigEndian.Uint32(v)
+		return nil
+	})
+	return index, err
+}
+
+func setAddressIndex(txn *badger.Txn, branch, index uint32) error {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, index)
+	return txn.Set(addressIndexKey(branch), buf)
+}
+
+// putAddressRecord stores the record and moves the counter of its branch
+// past it.
+func putAddressRecord(txn *badger.Txn, rec *AddressRecord) error {
+	buf, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if err = txn.Set(addressKey(rec.Address), buf); err != nil {
+		return err
+	}
+	if err = txn.Set(addressPathKey(rec.Path), []byte(rec.Address)); err != nil {
+		return err
+	}
+	if rec.UserId != "" {
+		if err = txn.Set(append(userAddressKeyPrefix(rec.UserId), rec.Address...), nil); err != nil {
+			return err
+		}
+	}
+	next, err := nextAddressIndex(txn, rec.Path.Branch)
+	if err != nil {
+		return err
+	}
+	if rec.Path.Index >= next {
+		return setAddressIndex(txn, rec.Path.Branch, rec.Path.Index+1)
+	}
+	return nil
+}
+
+// syncAddressIndex mirrors the counter into the config, which still carries
+// it in config.ini.
+func syncAddressIndex(config *conf.Config, branch, index uint32) {
+	if branch == util.BRANCH_EXTERNAL {
+		config.Index = index
+	} else if branch == util.BRANCH_INTERNAL {
+		config.InIndex = index
+	}
+}
+
+// peekAddress derives the address the next issueAddress on the branch gives,
+// without issuing it. The address goes into the cache already, so a tx paying
+// it is parsed as ours before it is issued. The caller holds m.
+func peekAddress(config *conf.Config, branch uint32) (string, error) {
+	var index uint32
+	err := db.View(func(txn *badger.Txn) error {
+		var err error
+		index, err = nextAddressIndex(txn, branch)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	param := util.GetParamByName(config.ChainName)
+	path := util.AddrPath{Branch: branch, Index: index}
+	addr, err := util.DeriveAddress(config.Xpub, path, param)
+	if err != nil {
+		return "", err
+	}
+	util.StoreAddrPath(addr, path)
+	return addr, nil
+}
+
+// useChangeAddress issues the peeked inner address once a tx paying it is
+// broadcast, unless it was issued meanwhile. The caller holds m.
+func useChangeAddress(config *conf.Config, addr string) {
+	next, err := peekAddress(config, util.BRANCH_INTERNAL)
+	if err != nil {
+		log.Println("get change address err:", err)
+		return
+	}
+	if next != addr {
+		return
+	}
+	if _, err = issueAddress(config, util.BRANCH_INTERNAL, PURPOSE_CHANGE, "", ""); err != nil {
+		log.Println("issue change address err:", err)
+	}
+}
+
+// issueAddress registers the next address of the branch and moves the
+// counter past it in the same transaction, so an address handed out is
+// never issued again after a crash. The user id and label are optional.
+// The caller holds m.
+func issueAddress(config *conf.Config, branch uint32, purpose, userId, label string) (*AddressRecord, error) {
+	if err := checkAddressLabel(userId, label); err != nil {
+		return nil, err
+	}
+	param := util.GetParamByName(config.ChainName)
+	if purpose == "" {
+		purpose = defaultPurpose(branch)
+	}
+
+	var rec *AddressRecord
+	err := db.Update(func(txn *badger.Txn) error {
+		index, err := nextAddressIndex(txn, branch)
+		if err != nil {
+			return err
+		}
+		path := util.AddrPath{Branch: branch, Index: index}
+		addr, err := util.DeriveAddress(config.Xpub, path, param)
+		if err != nil {
+			return err
+		}
+		rec = &AddressRecord{Address: addr, Path: path, Created: time.Now().Unix(), UserId: userId, Label: label, Purpose: purpose}
+		return putAddressRecord(txn, rec)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	util.StoreAddrPath(rec.Address, rec.Path)
+	syncAddressIndex(config, branch, rec.Path.Index+1)
+	return rec, nil
+}
+
+// lookupAddress returns the record of an issued address.
+func lookupAddress(address string) (*AddressRecord, error) {
+	var rec *AddressRecord
+	err := db.View(func(txn *badger.Txn) error {
+		var err error
+		rec, err = getAddressRecord(txn, address)
+		return err
+	})
+	return rec, err
+}
+
+// userAddresses returns the addresses bound to the user, oldest first.
+func userAddresses(userId string) ([]AddressRecord, error) {
+	recs := make([]AddressRecord, 0)
+	err := db.View(func(txn *badger.Txn) error {
+		prefix := userAddressKeyPrefix(userId)
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = prefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			rec, err := getAddressRecord(txn, string(it.Item().Key()[len(prefix):]))
+			if err != nil {
+				return err
+			}
+			recs = append(recs, *rec)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(recs, func(i, j int) bool {
+		return recs[i].Path.Index < recs[j].Path.Index
+	})
+	return recs, nil
+}
+
+// fillAddressRegistry registers the missing addresses of the branch below
+// total, and moves the counter up to it.
+func fillAddressRegistry(config *conf.Config, param *chaincfg.Params, branch, total uint32) (int, error) {
+	n := 0
+	now := time.Now().Unix()
+	for start := uint32(0); start < total; start += ADDRESS_BATCH_SIZE {
+		end := start + ADDRESS_BATCH_SIZE
+		if end > total {
+			end = total
+		}
+		added := make([]AddressRecord, 0)
+		err := db.Update(func(txn *badger.Txn) error {
+			for i := start; i < end; i++ {
+				path := util.AddrPath{Branch: branch, Index: i}
+				if _, err := txn.Get(addressPathKey(path)); err == nil {
+					continue
+				} else if err != badger.ErrKeyNotFound {
+					return err
+				}
+				addr, err := util.DeriveAddress(config.Xpub, path, param)
+				if err != nil {
+					return err
+				}
+				rec := AddressRecord{Address: addr, Path: path, Created: now, Purpose: defaultPurpose(branch)}
+				if err = putAddressRecord(txn, &rec); err != nil {
+					return err
+				}
+				added = append(added, rec)
+			}
+			return nil
+		})
+		if err != nil {
+			return n, err
+		}
+		for _, rec := range added {
+			util.StoreAddrPath(rec.Address, rec.Path)
+		}
+		n += len(added)
+	}
+	return n, nil
+}
+
+// loadAddressRegistry brings the registry up to the counters of the config,
+// registering the addresses of an older db on the first run, and loads it
+// into the address cache.
+func loadAddressRegistry(config *conf.Config, param *chaincfg.Params) error {
+	for _, branch := range []uint32{util.BRANCH_EXTERNAL, util.BRANCH_INTERNAL} {
+		total := config.Index
+		if branch == util.BRANCH_INTERNAL {
+			total = config.InIndex
+			// the first inner address is the default sender and receiver
+			if total == 0 {
+				total = 1
+			}
+		}
+		n, err := fillAddressRegistry(config, param, branch, total)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			log.Println("register", n, "addresses of branch", branch)
+		}
+	}
+
+	n := 0
+	err := db.View(func(txn *badger.Txn) error {
+		for _, branch := range []uint32{util.BRANCH_EXTERNAL, util.BRANCH_INTERNAL} {
+			index, err := nextAddressIndex(txn, branch)
+			if err != nil {
+				return err
+			}
+			syncAddressIndex(config, branch, index)
+		}
+
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(ADDRESS_KEY_PREFIX)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			var rec AddressRecord
+			err := it.Item().Value(func(v []byte) error {
+				return json.Unmarshal(v, &rec)
+			})
+			if err != nil {
+				log.Println("read address record err:", err, string(it.Item().Key()))
+				continue
+			}
+			util.StoreAddrPath(rec.Address, rec.Path)
+			n++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	inner, _ := util.DeriveAddress(config.Xpub, util.AddrPath{Branch: util.BRANCH_INTERNAL, Index: 0}, param)
+	log.Println("loaded", n, "addresses, index:", config.Index, "change index:", config.InIndex)
+	log.Println("inner withdraw addr:", inner)
+	return nil
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/rpcclient"
+	"log"
+
+	badger "github.com/dgraph-io/badger"
+)
+
+const (
+	// deepest reorganization the listener is able to roll back
+	MAX_REORG_DEPTH = 100
+
+	HEADER_KEY_PREFIX = "header/"
+	UNDO_KEY_PREFIX   = "undo/"
+)
+
+var errChainReorg = errors.New("chain reorganization detected")
+
+// BlockUndo records the wallet changes made by one block so that they can be
+// reverted when the block is orphaned.
+type BlockUndo struct {
+	Hash    string
+	Height  uint64
+	Created []Utxo
+	Spent   []Utxo
+	// tx of the block spending each wallet outpoint, by outpoint key
+	Spenders map[string]string `json:",omitempty"`
+	Messages []NotifyMessage
+}
+
+func heightKey(prefix string, height uint64) []byte {
+	key := make([]byte, len(prefix)+8)
+	copy(key, prefix)
+	binary.BigEndian.PutUint64(key[len(prefix):], height)
+	return key
+}
+
+func getBlockHash(height uint64) (string, error) {
+	var hash string
+	err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(heightKey(HEADER_KEY_PREFIX, height))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(v []byte) error {
+			hash = string(v)
+			return nil
+		})
+	})
+	return hash, err
+}
+
+// getTopBlockHeight returns the highest height in the stored header chain.
+func getTopBlockHeight() (uint64, bool) {
+	var (
+		height uint64
+		found  bool
+	)
+	db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Reverse = true
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		prefix := []byte(HEADER_KEY_PREFIX)
+		it.Seek(append(prefix, 0xff))
+		if it.ValidForPrefix(prefix) {
+			height = binary.BigEndian.Uint64(it.Item().Key()[len(prefix):])
+			found = true
+		}
+		return nil
+	})
+	return height, found
+}
+
+func saveBlockUndo(height uint64, undo *BlockUndo) error {
+	buf, err := json.Marshal(undo)
+	if err != nil {
+		return err
+	}
+
+	return db.Update(func(txn *badger.Txn) error {
+		err := txn.Set(heightKey(HEADER_KEY_PREFIX, height), []byte(undo.Hash))
+		if err != nil {
+			return err
+		}
+		err = txn.Set(heightKey(UNDO_KEY_PREFIX, height), buf)
+		if err != nil {
+			return err
+		}
+		// blocks deeper than this can never be rolled back, drop their undo data
+		if height > MAX_REORG_DEPTH {
+			err = txn.Delete(heightKey(UNDO_KEY_PREFIX, height-MAX_REORG_DEPTH))
+		}
+		return err
+	})
+}
+
+func getBlockUndo(height uint64) (*BlockUndo, error) {
+	undo := new(BlockUndo)
+	err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(heightKey(UNDO_KEY_PREFIX, height))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(v []byte) error {
+			return json.Unmarshal(v, undo)
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return undo, nil
+}
+
+// spentIn is the tx of a stored block which spent a wallet outpoint.
+type spentIn struct {
+	TxHash string
+	Height uint64
+}
+
+// findSpenders looks the outpoints up in the stored undo records and returns
+// the txs which spent them, by outpoint key.
+func findSpenders(outpoints []string) (map[string]spentIn, error) {
+	spenders := make(map[string]spentIn)
+	err := db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(UNDO_KEY_PREFIX)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			undo := new(BlockUndo)
+			err := it.Item().Value(func(v []byte) error {
+				return json.Unmarshal(v, undo)
+			})
+			if err != nil {
+				return err
+			}
+			for _, key := range outpoints {
+				if spender, ok := undo.Spenders[key]; ok {
+					spenders[key] = spentIn{TxHash: spender, Height: undo.Height}
+				}
+			}
+		}
+		return nil
+	})
+	return spenders, err
+}
+
+func deleteBlock(height uint64) error {
+	return db.Update(func(txn *badger.Txn) error {
+		err := txn.Delete(heightKey(HEADER_KEY_PREFIX, height))
+		if err != nil {
+			return err
+		}
+		return txn.Delete(heightKey(UNDO_KEY_PREFIX, height))
+	})
+}
+
+// findForkPoint walks back from height until the stored block hash matches
+// the one on the node's best chain.
+func findForkPoint(client *rpcclient.Client, height uint64) (uint64, error) {
+	for h := height; h > 0; h-- {
+		if height-h > MAX_REORG_DEPTH {
+			return 0, fmt.Errorf("reorg deeper than %d blocks at %d", MAX_REORG_DEPTH, height)
+		}
+
+		stored, err := getBlockHash(h)
+		if err == badger.ErrKeyNotFound {
+			// nothing recorded before here, it is the best we can do
+			return h, nil
+		} else if err != nil {
+			return 0, err
+		}
+
+		hash, err := client.GetBlockHash(int64(h))
+		if err != nil {
+			return 0, fmt.Errorf("read block hash err: %v", err)
+		}
+		if hash.String() == stored {
+			return h, nil
+		}
+	}
+	return 0, nil
+}
+
+// revertBlock undoes the utxo changes of an orphaned block. Transactions that
+// were already delivered are sent again flagged as reverted, the others are
+// marked reverted so the Notifier drops them if they are still queued.
+func revertBlock(height uint64, notifyChannel chan<- NotifyMessage) error {
+	undo, err := getBlockUndo(height)
+	if err != nil {
+		log.Println("no undo data for block", height, "err:", err)
+		return deleteBlock(height)
+	}
+	log.Println("revert block", height, undo.Hash)
+
+	created := make(map[string]bool)
+	for _, u := range undo.Created {
+		removeUtxo(u.Hash, u.Index)
+		created[fmt.Sprintf("%s/%d", u.Hash, u.Index)] = true
+	}
+	for _, u := range undo.Spent {
+		// outputs created and spent in the same block never existed before it
+		if created[fmt.Sprintf("%s/%d", u.Hash, u.Index)] {
+			continue
+		}
+		createUtxo(u)
+	}
+
+	for _, message := range undo.Messages {
+		d, err := getDelivery(message)
+		if err != nil {
+			continue
+		}
+		if d.State == DELIVERY_DELIVERED {
+			message.Reverted = true
+			notifyChannel <- message
+		} else {
+			d.State = DELIVERY_REVERTED
+			if err = saveDelivery(d); err != nil {
+				log.Println("save delivery err:", err, message.TxHash)
+			}
+		}
+	}
+	deletePoolBlock(height)
+
+	return deleteBlock(height)
+}
+
+// rollbackChain reverts every stored block above the fork point and returns
+// the height the listener should continue scanning from.
+func rollbackChain(client *rpcclient.Client, notifyChannel chan<- NotifyMessage) (uint64, error) {
+	top, ok := getTopBlockHeight()
+	if !ok {
+		return 0, errors.New("no block header stored")
+	}
+
+	fork, err := findForkPoint(client, top)
+	if err != nil {
+		return 0, err
+	}
+	log.Println("chain reorg found, fork point:", fork, "top:", top)
+
+	for h := top; h > fork; h-- {
+		err = revertBlock(h, notifyChannel)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return fork + 1, nil
+}
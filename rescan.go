@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/btcsuite/btcd/chaincfg"
+	conf "github.com/bytefly/dashcash-wallet/config"
+	"log"
+	"os"
+	"time"
+
+	badger "github.com/dgraph-io/badger"
+)
+
+// the state derived from the blocks, rebuilt by a rescan
+var rescanPrefixes = []string{
+	UTXO_KEY_PREFIX,
+	ADDR_KEY_PREFIX,
+	BRANCH_KEY_PREFIX,
+	HEADER_KEY_PREFIX,
+	UNDO_KEY_PREFIX,
+	UTXO_VERSION_KEY,
+}
+
+// keepForRescan tells whether the record of the old db goes into the rebuilt
+// one. The headers below the rescan height are kept to link the first block.
+func keepForRescan(key []byte, from uint64) bool {
+	if bytes.HasPrefix(key, []byte(HEADER_KEY_PREFIX)) && len(key) == len(HEADER_KEY_PREFIX)+8 {
+		return binary.BigEndian.Uint64(key[len(HEADER_KEY_PREFIX):]) < from
+	}
+	for _, prefix := range rescanPrefixes {
+		if bytes.HasPrefix(key, []byte(prefix)) {
+			return false
+		}
+	}
+	return true
+}
+
+// copyForRescan copies the records the blocks cannot give back, such as the
+// sent txs, withdrawals and freezes, from the old db into the new one.
+func copyForRescan(shadow *badger.DB, from uint64) (int, error) {
+	wb := shadow.NewWriteBatch()
+	defer wb.Cancel()
+
+	n := 0
+	err := db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			if !keepForRescan(item.Key(), from) {
+				continue
+			}
+			val, err := item.ValueCopy(nil)
+			if err != nil {
+				log.Println("read record err:", err, string(item.Key()))
+				continue
+			}
+			e := badger.NewEntry(item.KeyCopy(nil), val)
+			if expires := item.ExpiresAt(); expires > 0 {
+				ttl := time.Until(time.Unix(int64(expires), 0))
+				if ttl <= 0 {
+					continue
+				}
+				e = e.WithTTL(ttl)
+			}
+			if err = wb.SetEntry(e); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	if err != nil {
+		return n, err
+	}
+	return n, wb.Flush()
+}
+
+// rescanFrom rebuilds the wallet db in a shadow directory by replaying the
+// blocks from the height to the tip, then swaps it in place of the current
+// one, which is kept as <dbDir>.old-<time>. The address registry is kept,
+// and nothing is notified for the replayed blocks. On failure
+// the current db is left as it was.
+func rescanFrom(config *conf.Config, param *chaincfg.Params, from uint64) error {
+	shadowDir := config.DBDir + ".rescan"
+	if err := os.RemoveAll(shadowDir); err != nil {
+		return err
+	}
+	shadow, err := badger.Open(badger.DefaultOptions(shadowDir))
+	if err != nil {
+		return err
+	}
+
+	n, err := copyForRescan(shadow, from)
+	if err != nil {
+		shadow.Close()
+		return fmt.Errorf("copy records err: %v", err)
+	}
+	log.Println("rescan: kept", n, "records of the current db")
+
+	// replay into the shadow db
+	closeDb()
+	db = shadow
+	if err = migrateUtxoDb(param); err == nil {
+		err = replayBlocks(config, from)
+	}
+	if err == nil {
+		err = dropMempoolSpent()
+	}
+	closeDb()
+	db = nil
+	if err != nil {
+		return err
+	}
+
+	oldDir := fmt.Sprintf("%s.old-%d", config.DBDir, time.Now().Unix())
+	if err = os.Rename(config.DBDir, oldDir); err != nil {
+		return err
+	}
+	if err = os.Rename(shadowDir, config.DBDir); err != nil {
+		// put the current db back
+		os.Rename(oldDir, config.DBDir)
+		return err
+	}
+	log.Println("rescan: rebuilt db in place, the old one is", oldDir)
+	return nil
+}
+
+// dropMempoolSpent removes the replayed utxos spent by our txs still in the
+// mempool, which the copied mspent/ records keep track of.
+func dropMempoolSpent() error {
+	spent := make([]Utxo, 0)
+	err := iterateUtxo([]byte(MEMPOOL_SPENT_KEY_PREFIX), func(u *Utxo) {
+		spent = append(spent, *u)
+	})
+	if err != nil {
+		return err
+	}
+
+	n := 0
+	for _, u := range spent {
+		if _, err = removeUtxo(u.Hash, u.Index); err == nil {
+			n++
+		} else if err != badger.ErrKeyNotFound {
+			return err
+		}
+	}
+	if n > 0 {
+		log.Println("rescan: drop", n, "utxos spent in the mempool")
+	}
+	return nil
+}
+
+// replayBlocks applies the blocks from the height to the tip without
+// notifying anything, and moves LastBlock past them.
+func replayBlocks(config *conf.Config, from uint64) error {
+	client, err := ConnectRPC(config)
+	if err != nil {
+		return err
+	}
+	defer client.Shutdown()
+
+	tip, err := client.GetBlockCount()
+	if err != nil {
+		return err
+	}
+	if int64(from) > tip {
+		return fmt.Errorf("rescan height %d above the tip %d", from, tip)
+	}
+	log.Println("rescan: replay blocks", from, "to", tip)
+
+	quit := make(chan struct{})
+	defer close(quit)
+	start := time.Now()
+	for b := range fetchBlocks(client, int64(from), tip, config.FetchWorkers, quit) {
+		if b.Err != nil {
+			return b.Err
+		}
+		_, err = processBlock(newPrevoutCache(client, b.Block, b.Prevouts), uint64(b.Height), b.Block, config.ChainName, false)
+		if err == errChainReorg {
+			return fmt.Errorf("chain reorganized at %d during the rescan", b.Height)
+		}
+		if err != nil {
+			return err
+		}
+		if b.Height%1000 == 0 {
+			log.Println("rescan: block", b.Height, "of", tip, "in", time.Since(start))
+		}
+	}
+
+	config.LastBlock = uint64(tip) + 1
+	log.Println("rescan: replayed", uint64(tip)+1-from, "blocks in", time.Since(start))
+	return nil
+}
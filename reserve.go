@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/btcsuite/btcd/wire"
+	"log"
+	"time"
+
+	badger "github.com/dgraph-io/badger"
+)
+
+const RESERVE_KEY_PREFIX = "reserve/"
+
+// Reservation keeps a utxo out of coin selection while the unsigned tx it
+// was put into is being signed somewhere else.
+type Reservation struct {
+	Hash    string
+	Index   uint32
+	TxHash  string
+	Created int64
+	Expires int64
+}
+
+func reserveKey(hash string, index uint32) []byte {
+	return []byte(RESERVE_KEY_PREFIX + outpointKey(hash, index))
+}
+
+// reserveInputs reserves all the inputs of the unsigned tx and returns the
+// reservation id, the reservations are dropped by badger once they expire.
+func reserveInputs(tx *wire.MsgTx, ttl time.Duration) (string, error) {
+	id := tx.TxHash().String()
+	now := time.Now()
+	err := db.Update(func(txn *badger.Txn) error {
+		for _, in := range tx.TxIn {
+			r := Reservation{
+				Hash:    in.PreviousOutPoint.Hash.String(),
+				Index:   in.PreviousOutPoint.Index,
+				TxHash:  id,
+				Created: now.Unix(),
+				Expires: now.Add(ttl).Unix(),
+			}
+			buf, err := json.Marshal(&r)
+			if err != nil {
+				return err
+			}
+			err = txn.SetEntry(badger.NewEntry(reserveKey(r.Hash, r.Index), buf).WithTTL(ttl))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	log.Println("reserve", len(tx.TxIn), "utxos for", id)
+	return id, nil
+}
+
+// releaseInputs drops the reservations of the tx inputs.
+func releaseInputs(tx *wire.MsgTx) error {
+	return db.Update(func(txn *badger.Txn) error {
+		for _, in := range tx.TxIn {
+			err := txn.Delete(reserveKey(in.PreviousOutPoint.Hash.String(), in.PreviousOutPoint.Index))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func releaseOutpoint(hash string, index uint32) error {
+	return db.Update(func(txn *badger.Txn) error {
+		_, err := txn.Get(reserveKey(hash, index))
+		if err != nil {
+			return err
+		}
+		return txn.Delete(reserveKey(hash, index))
+	})
+}
+
+// releaseReservation drops every utxo reserved for the unsigned tx id and
+// returns how many were released.
+func releaseReservation(id string) (int, error) {
+	reservations, err := listReservations()
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	err = db.Update(func(txn *badger.Txn) error {
+		for _, r := range reservations {
+			if r.TxHash != id {
+				continue
+			}
+			if err := txn.Delete(reserveKey(r.Hash, r.Index)); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+func listReservations() ([]Reservation, error) {
+	reservations := make([]Reservation, 0)
+	err := db.View(func(txn *badger.Txn) error {
+		prefix := []byte(RESERVE_KEY_PREFIX)
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			err := it.Item().Value(func(v []byte) error {
+				var r Reservation
+				if err := json.Unmarshal(v, &r); err != nil {
+					return err
+				}
+				reservations = append(reservations, r)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return reservations, err
+}
+
+// filterReserved removes the reserved utxos from the selection candidates.
+// The selection must be aborted on error, the reservations being unknown.
+func filterReserved(utxos []Utxo) ([]Utxo, error) {
+	reservations, err := listReservations()
+	if err != nil {
+		return nil, fmt.Errorf("list reservations err: %v", err)
+	}
+	if len(reservations) == 0 {
+		return utxos, nil
+	}
+
+	reserved := make(map[string]bool)
+	for _, r := range reservations {
+		reserved[outpointKey(r.Hash, r.Index)] = true
+	}
+
+	free := utxos[:0]
+	for _, u := range utxos {
+		if !reserved[outpointKey(u.Hash, u.Index)] {
+			free = append(free, u)
+		}
+	}
+	return free, nil
+}
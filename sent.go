@@ -0,0 +1,473 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/wire"
+	conf "github.com/bytefly/dashcash-wallet/config"
+	"log"
+	"time"
+
+	badger "github.com/dgraph-io/badger"
+)
+
+const (
+	SENT_MEMPOOL = iota
+	SENT_CONFIRMED
+	SENT_EVICTED
+	SENT_CONFLICTED
+	SENT_REPLACED
+
+	// stop watching a tx once it is this deep
+	SENT_FINAL_CONFIRMATIONS = 6
+
+	SENT_KEY_PREFIX    = "sent/"
+	WATCHED_KEY_PREFIX = "watched/"
+)
+
+var sentStatusNames = []string{"mempool", "confirmed", "evicted", "conflicted", "replaced"}
+
+// SentTx is a tx signed and broadcast by the wallet. The spent utxos are
+// kept since they leave the utxo set once the tx is in the mempool.
+type SentTx struct {
+	Hash string
+	// signed tx in hex
+	Raw        string
+	Inputs     []Utxo
+	Fee        int64
+	FeeRate    uint32
+	Replaces   string
+	ReplacedBy string
+	Created    int64
+	// moves wallet funds into the inner addresses: sweeps, dust spends,
+	// consolidations and CPFP children, recorded as fund collections of
+	// user id 0
+	Sweep bool
+
+	Status        int
+	Confirmations int64
+	Rebroadcasts  int
+	Error         string
+	Checked       int64
+}
+
+// watched tells whether the monitor still has to check the tx.
+func (s *SentTx) watched() bool {
+	switch s.Status {
+	case SENT_MEMPOOL, SENT_EVICTED:
+		return true
+	case SENT_CONFIRMED:
+		return s.Confirmations < SENT_FINAL_CONFIRMATIONS
+	}
+	return false
+}
+
+func sentKey(hash string) []byte {
+	return []byte(SENT_KEY_PREFIX + hash)
+}
+
+func saveSentTx(s *SentTx) error {
+	buf, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	return db.Update(func(txn *badger.Txn) error {
+		if err := txn.Set(sentKey(s.Hash), buf); err != nil {
+			return err
+		}
+		if s.watched() {
+			return txn.Set([]byte(WATCHED_KEY_PREFIX+s.Hash), nil)
+		}
+		return txn.Delete([]byte(WATCHED_KEY_PREFIX + s.Hash))
+	})
+}
+
+func getSentTx(hash string) (*SentTx, error) {
+	s := new(SentTx)
+	err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(sentKey(hash))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(v []byte) error {
+			return json.Unmarshal(v, s)
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// inputUtxos returns the wallet utxos spent by the tx.
+func inputUtxos(tx *wire.MsgTx) ([]Utxo, error) {
+	inputs := make([]Utxo, 0, len(tx.TxIn))
+	err := db.View(func(txn *badger.Txn) error {
+		for _, in := range tx.TxIn {
+			u, err := getUtxo(txn, in.PreviousOutPoint.Hash.String(), in.PreviousOutPoint.Index)
+			if err != nil {
+				return err
+			}
+			inputs = append(inputs, *u)
+		}
+		return nil
+	})
+	return inputs, err
+}
+
+func newSentTx(signedTx *wire.MsgTx, inputs []Utxo, feeRate uint32) *SentTx {
+	var buf bytes.Buffer
+	signedTx.Serialize(&buf)
+
+	s := &SentTx{
+		Hash:    signedTx.TxHash().String(),
+		Raw:     hex.EncodeToString(buf.Bytes()),
+		Inputs:  inputs,
+		FeeRate: feeRate,
+		Created: time.Now().Unix(),
+	}
+	if len(inputs) != len(signedTx.TxIn) {
+		return s
+	}
+	for _, u := range inputs {
+		s.Fee += u.Value
+	}
+	for _, out := range signedTx.TxOut {
+		s.Fee -= out.Value
+	}
+	return s
+}
+
+// broadcastTx sends a tx signed by the wallet, records it and updates the
+// utxo set.
+func broadcastTx(config *conf.Config, signedTx *wire.MsgTx, feeRate uint32) (string, error) {
+	// the inputs leave the utxo set as soon as the tx reaches the mempool
+	inputs, err := inputUtxos(signedTx)
+	if err != nil {
+		log.Println("get tx inputs err:", err)
+	}
+
+	hash, err := SendTransaction(config, signedTx)
+	if err != nil {
+		return hash, err
+	}
+	recordSentTx(config, signedTx, inputs, feeRate)
+	return hash, nil
+}
+
+// recordSentTx keeps a tx the node took for the monitor and applies it to
+// the utxo set.
+func recordSentTx(config *conf.Config, signedTx *wire.MsgTx, inputs []Utxo, feeRate uint32) {
+	hash := signedTx.TxHash().String()
+	if err := saveSentTx(newSentTx(signedTx, inputs, feeRate)); err != nil {
+		log.Println("save sent tx err:", err, hash)
+	}
+	if err := ParseMempoolTransaction(config, signedTx, config.ChainName); err != nil {
+		log.Println("parse signed tx error:", err)
+	}
+}
+
+func (s *SentTx) MsgTx() (*wire.MsgTx, error) {
+	return decodeRawTx(s.Raw)
+}
+
+// decodeRawTx decodes a tx in hex.
+func decodeRawTx(str string) (*wire.MsgTx, error) {
+	raw, err := hex.DecodeString(str)
+	if err != nil {
+		return nil, err
+	}
+	tx := new(wire.MsgTx)
+	if err = tx.Deserialize(bytes.NewReader(raw)); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// originalTxHash returns the first tx of the replacement chain ending with
+// hash, or "" when hash replaces nothing.
+func originalTxHash(hash string) string {
+	orig := ""
+	for {
+		s, err := getSentTx(hash)
+		if err != nil || s.Replaces == "" {
+			return orig
+		}
+		orig = s.Replaces
+		hash = s.Replaces
+	}
+}
+
+func watchedTxs() ([]string, error) {
+	hashes := make([]string, 0)
+	err := db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		prefix := []byte(WATCHED_KEY_PREFIX)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			hashes = append(hashes, string(it.Item().Key()[len(prefix):]))
+		}
+		return nil
+	})
+	return hashes, err
+}
+
+// minedTx tells from the wallet's own block data whether the tx is mined and
+// at which height, or which other tx of a stored block spent one of its
+// inputs. Once the undo records of its block are dropped, a mined tx is only
+// seen through its unspent outputs.
+func minedTx(tx *wire.MsgTx) (uint64, string, error) {
+	hash := tx.TxHash().String()
+	var height uint64
+	err := db.View(func(txn *badger.Txn) error {
+		for i := range tx.TxOut {
+			u, err := getUtxo(txn, hash, uint32(i))
+			if err != nil {
+				u, err = getMempoolSpent(txn, hash, uint32(i))
+			}
+			if err == nil && u.Height > 0 {
+				height = u.Height
+				return nil
+			}
+		}
+		return nil
+	})
+	if err != nil || height > 0 {
+		return height, "", err
+	}
+
+	keys := make([]string, 0, len(tx.TxIn))
+	for _, in := range tx.TxIn {
+		keys = append(keys, outpointKey(in.PreviousOutPoint.Hash.String(), in.PreviousOutPoint.Index))
+	}
+	spenders, err := findSpenders(keys)
+	if err != nil {
+		return 0, "", err
+	}
+	conflict := ""
+	for _, key := range keys {
+		spender, ok := spenders[key]
+		if !ok {
+			continue
+		}
+		if spender.TxHash == hash {
+			return spender.Height, "", nil
+		}
+		conflict = spender.TxHash
+	}
+	return 0, conflict, nil
+}
+
+// checkSentTx updates the status of a broadcast tx, and sends it again when
+// it fell out of the mempool while its inputs are unspent. Confirmation is
+// decided from the wallet's block data first, since a node without a tx
+// index cannot see a mined tx whose outputs are all spent. The tx is only
+// conflicted once another tx spending one of its inputs is known.
+func checkSentTx(config *conf.Config, client *rpcclient.Client, s *SentTx) {
+	tx, err := s.MsgTx()
+	if err != nil {
+		log.Println("invalid sent tx:", err, s.Hash)
+		return
+	}
+	hash := tx.TxHash()
+	s.Checked = time.Now().Unix()
+
+	if _, err = client.GetMempoolEntry(s.Hash); err == nil {
+		s.Status = SENT_MEMPOOL
+		s.Confirmations = 0
+		s.Error = ""
+		return
+	}
+
+	height, conflict, err := minedTx(tx)
+	if err != nil {
+		log.Println("read wallet blocks err:", err, s.Hash)
+		return
+	}
+	if height > 0 {
+		s.Status = SENT_CONFIRMED
+		s.Confirmations = 1
+		if top, ok := getTopBlockHeight(); ok && top >= height {
+			s.Confirmations = int64(top - height + 1)
+		}
+		s.Error = ""
+		return
+	}
+	if conflict != "" {
+		if s.Status != SENT_CONFLICTED {
+			log.Println("tx", s.Hash, "conflicts with", conflict)
+			conflictSentTx(s, tx)
+		}
+		s.Status = SENT_CONFLICTED
+		s.Error = fmt.Sprintf("input spent by tx %s", conflict)
+		return
+	}
+
+	if res, err := client.GetRawTransactionVerbose(&hash); err == nil && res.Confirmations > 0 {
+		s.Status = SENT_CONFIRMED
+		s.Confirmations = int64(res.Confirmations)
+		return
+	}
+	// without a tx index a confirmed tx is only seen through its outputs
+	for i := range tx.TxOut {
+		out, err := client.GetTxOut(&hash, uint32(i), false)
+		if err == nil && out != nil && out.Confirmations > 0 {
+			s.Status = SENT_CONFIRMED
+			s.Confirmations = out.Confirmations
+			return
+		}
+	}
+
+	for _, in := range tx.TxIn {
+		out, err := client.GetTxOut(&in.PreviousOutPoint.Hash, in.PreviousOutPoint.Index, true)
+		if err != nil {
+			log.Println("get txout err:", err, in.PreviousOutPoint)
+			return
+		}
+		if out == nil {
+			// spent by a tx the wallet has not seen in a block yet, it may
+			// still be this one
+			log.Println("input", in.PreviousOutPoint, "of tx", s.Hash, "spent by an unknown tx")
+			s.Error = fmt.Sprintf("input %s spent by an unknown tx", in.PreviousOutPoint)
+			return
+		}
+	}
+
+	log.Println("tx", s.Hash, "evicted from the mempool, rebroadcast it")
+	s.Status = SENT_EVICTED
+	s.Rebroadcasts++
+	if _, err = client.SendRawTransaction(tx, false); err != nil {
+		log.Println("rebroadcast tx err:", err, s.Hash)
+		s.Error = err.Error()
+		// its inputs are unspent on the node, give them back until it is
+		// taken again, and drop its outputs so they are not spent with them
+		for i := range tx.TxOut {
+			removeUtxo(s.Hash, uint32(i))
+		}
+		for _, in := range tx.TxIn {
+			restoreMempoolSpent(in.PreviousOutPoint.Hash.String(), in.PreviousOutPoint.Index)
+		}
+		return
+	}
+	// spend the inputs and add the outputs again after a failed rebroadcast
+	if err = ParseMempoolTransaction(config, tx, config.ChainName); err != nil {
+		log.Println("parse rebroadcast tx err:", err, s.Hash)
+	}
+	s.Status = SENT_MEMPOOL
+	s.Error = ""
+}
+
+// conflictSentTx drops the outputs of a tx which will never be mined and
+// fails the withdrawals it paid. Its inputs spent by another tx are
+// forgotten, the others are given back.
+func conflictSentTx(s *SentTx, tx *wire.MsgTx) {
+	for i := range tx.TxOut {
+		removeUtxo(s.Hash, uint32(i))
+	}
+
+	keys := make([]string, 0, len(tx.TxIn))
+	for _, in := range tx.TxIn {
+		keys = append(keys, outpointKey(in.PreviousOutPoint.Hash.String(), in.PreviousOutPoint.Index))
+	}
+	spenders, err := findSpenders(keys)
+	if err != nil {
+		log.Println("read wallet blocks err:", err, s.Hash)
+	} else {
+		for i, in := range tx.TxIn {
+			hash, index := in.PreviousOutPoint.Hash.String(), in.PreviousOutPoint.Index
+			if _, ok := spenders[keys[i]]; ok {
+				forgetMempoolSpent(hash, index)
+			} else {
+				restoreMempoolSpent(hash, index)
+			}
+		}
+	}
+
+	batch, err := getBatch(s.Hash)
+	if err != nil {
+		return
+	}
+	for _, o := range batch {
+		if o.Withdrawal == 0 {
+			continue
+		}
+		w, err := getWithdrawal(o.Withdrawal)
+		if err != nil || w.TxHash != s.Hash {
+			continue
+		}
+		w.State = WITHDRAWAL_FAILED
+		w.Error = "tx conflicted"
+		if err = saveWithdrawal(w); err != nil {
+			log.Println("save withdrawal err:", err, w.Id)
+		}
+	}
+}
+
+func checkSentTxs(config *conf.Config) {
+	hashes, err := watchedTxs()
+	if err != nil {
+		log.Println("list watched txs err:", err)
+		return
+	}
+	if len(hashes) == 0 {
+		return
+	}
+
+	client, err := ConnectRPC(config)
+	if err != nil {
+		return
+	}
+	defer client.Shutdown()
+
+	for _, hash := range hashes {
+		checkWatchedTx(config, client, hash)
+	}
+}
+
+// checkWatchedTx reads, checks and saves a sent tx under m, so a fee bump
+// setting ReplacedBy meanwhile is never overwritten.
+func checkWatchedTx(config *conf.Config, client *rpcclient.Client, hash string) {
+	m.Lock()
+	defer m.Unlock()
+
+	s, err := getSentTx(hash)
+	if err != nil {
+		log.Println("get sent tx err:", err, hash)
+		return
+	}
+	if s.ReplacedBy != "" {
+		s.Status = SENT_REPLACED
+	} else {
+		checkSentTx(config, client, s)
+	}
+	if err = saveSentTx(s); err != nil {
+		log.Println("save sent tx err:", err, hash)
+	}
+}
+
+// BroadcastMonitor checks the broadcast txs every interval until quit is closed.
+func BroadcastMonitor(config *conf.Config, quit <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	interval := config.TxCheckInterval
+	if interval == 0 {
+		interval = 1
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+		checkSentTxs(config)
+	}
+}
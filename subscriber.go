@@ -1,6 +1,8 @@
 package main
 
 import (
+	"fmt"
+	"github.com/btcsuite/btcd/rpcclient"
 	conf "github.com/bytefly/dashcash-wallet/config"
 	"github.com/bytefly/dashcash-wallet/util"
 	"log"
@@ -48,7 +50,8 @@ type ResponseMessage struct {
 }
 
 const (
-	TYPE_BLOCK_HASH  = iota
+	TYPE_BLOCK_HASH = iota
+	// defaults when the coin has no [confirm.<COIN>] section
 	MIN_BTC_AMOUNT   = 100000
 	MIN_CONFIRMATION = 3
 
@@ -66,7 +69,45 @@ type ObjMessage struct {
 	Number *big.Int
 }
 
-var blkPool = make(map[uint64][]NotifyMessage)
+func coinPolicy(config *conf.Config, coin string) *conf.CoinPolicy {
+	return config.Coins[strings.ReplaceAll(strings.ToUpper(coin), "TEST", "")]
+}
+
+// requiredConfirmations returns how deep the tx must be before it is notified.
+func requiredConfirmations(config *conf.Config, message NotifyMessage) uint64 {
+	confirmations := uint64(MIN_CONFIRMATION)
+	policy := coinPolicy(config, message.Coin)
+	if policy != nil {
+		if policy.Confirmations > 0 {
+			confirmations = policy.Confirmations
+		}
+		if message.Amount != nil {
+			for _, tier := range policy.Tiers {
+				if message.Amount.Int64() >= tier.Amount {
+					confirmations = tier.Confirmations
+				}
+			}
+		}
+	}
+
+	if confirmations == 0 {
+		confirmations = 1
+	}
+	return confirmations
+}
+
+// minDepositAmount returns the deposit amount below which user deposits are ignored.
+func minDepositAmount(config *conf.Config, coin string) int64 {
+	policy := coinPolicy(config, coin)
+	if policy != nil && policy.MinAmount >= 0 {
+		return policy.MinAmount
+	}
+
+	if strings.ReplaceAll(strings.ToUpper(coin), "TEST", "") == "BTC" {
+		return MIN_BTC_AMOUNT
+	}
+	return 0
+}
 
 func GetNewerBlock(config *conf.Config, ch chan<- ObjMessage) error {
 	client, err := ConnectRPC(config)
@@ -87,7 +128,56 @@ func GetNewerBlock(config *conf.Config, ch chan<- ObjMessage) error {
 	return nil
 }
 
-func Listener(config *conf.Config, ch <-chan ObjMessage, notifyChannel chan<- NotifyMessage, last_id uint64) {
+// catchUp applies the blocks from..to, fetched ahead in parallel and
+// committed in height order, and returns the next height to read. After a
+// rollback it returns early, with the height to start again from.
+func catchUp(config *conf.Config, client *rpcclient.Client, from, tip uint64, notifyChannel chan<- NotifyMessage) (uint64, error) {
+	quit := make(chan struct{})
+	defer close(quit)
+
+	next := from
+	for b := range fetchBlocks(client, int64(from), int64(tip), config.FetchWorkers, quit) {
+		if b.Err != nil {
+			return next, b.Err
+		}
+		txns, err := processBlock(newPrevoutCache(client, b.Block, b.Prevouts), next, b.Block, config.ChainName, true)
+		if err == errChainReorg {
+			back, err := rollbackChain(client, notifyChannel)
+			if err != nil {
+				return next, fmt.Errorf("rollback err: %v", err)
+			}
+			return back, nil
+		}
+		if err != nil {
+			return next, err
+		}
+
+		for _, txn := range txns {
+			if txn.MessageType == NOTIFY_TYPE_TX {
+				log.Println("new tx found:", txn.TxHash, "needs", requiredConfirmations(config, txn), "confirmations")
+			}
+		}
+
+		//put it in pool
+		if len(txns) > 0 {
+			if err = savePoolBlock(next, txns); err != nil {
+				return next, fmt.Errorf("save pool err: %v", err)
+			}
+			log.Println("add txs to", next, "txs size:", len(txns))
+		}
+		//broadcast the txs having enough confirmations
+		releasePool(config, tip, notifyChannel)
+
+		next++
+		config.LastBlock = next
+	}
+	return next, nil
+}
+
+// Listener processes the new blocks announced on ch until it is closed.
+func Listener(config *conf.Config, ch <-chan ObjMessage, notifyChannel chan<- NotifyMessage, last_id uint64, done chan<- struct{}) {
+	defer close(done)
+
 	client, err := ConnectRPC(config)
 	if err != nil {
 		panic(err)
@@ -100,63 +190,15 @@ func Listener(config *conf.Config, ch <-chan ObjMessage, notifyChannel chan<- No
 			last := new(big.Int)
 			last.SetUint64(last_id)
 
-			stop := new(big.Int)
-			stop.Sub(message.Number, big.NewInt(MIN_CONFIRMATION-1))
 			for last.Cmp(message.Number) <= 0 {
 				//log.Printf("Recovery: Doing block %s", last.Text(10))
-				txns, err := ReadBlock(client, last, config.ChainName)
+				next, err := catchUp(config, client, last.Uint64(), message.Number.Uint64(), notifyChannel)
+				last.SetUint64(next)
+				config.LastBlock = next
 				if err != nil {
 					log.Println("Listener:", err)
 					break
 				}
-
-				if last.Cmp(stop) < 0 {
-					for _, txn := range txns {
-						notifyChannel <- txn
-					}
-
-					notifyChannel <- NotifyMessage{
-						MessageType: NOTIFY_TYPE_ADMIN,
-						Amount:      last,
-					}
-				} else {
-					for _, txn := range txns {
-						if txn.MessageType == NOTIFY_TYPE_TX {
-							if txn.Amount.String() != "0" && txn.Coin == "BTC" {
-								if txn.Amount.Uint64() < MIN_BTC_AMOUNT {
-									continue
-								}
-							}
-							//remove non wallet txn
-							log.Println("new tx is confirmed:", txn.TxHash)
-						}
-					}
-
-					//put it in map
-					if len(txns) > 0 {
-						blkPool[last.Uint64()] = txns
-						log.Println("add txs to", last.Uint64(), "txs size:", len(txns))
-					}
-					//scan and broadcast 3 confirms
-					txns, ok := blkPool[last.Uint64()-MIN_CONFIRMATION+1]
-					if ok {
-						for _, txn := range txns {
-							notifyChannel <- txn
-						}
-
-						notifyChannel <- NotifyMessage{
-							MessageType: NOTIFY_TYPE_ADMIN,
-							Amount:      new(big.Int).Sub(last, big.NewInt(MIN_CONFIRMATION-1)),
-						}
-
-						// delete unconfirmed height txs map
-						delete(blkPool, last.Uint64()-MIN_CONFIRMATION+1)
-						log.Println("delete txs in block", last.Uint64()-MIN_CONFIRMATION+1)
-					}
-				}
-
-				last.SetUint64(last.Uint64() + 1)
-				config.LastBlock = last.Uint64()
 			}
 
 			// We set last_id a 0. We don't want this process to restart.
@@ -166,7 +208,10 @@ func Listener(config *conf.Config, ch <-chan ObjMessage, notifyChannel chan<- No
 	}
 }
 
-func Notifier(config *conf.Config, ch <-chan NotifyMessage) {
+// Notifier delivers the tx messages on ch until it is closed.
+func Notifier(config *conf.Config, ch <-chan NotifyMessage, done chan<- struct{}) {
+	defer close(done)
+
 	var (
 		symbol string
 		addr   string
@@ -190,30 +235,87 @@ func Notifier(config *conf.Config, ch <-chan NotifyMessage) {
 		fee = util.LeftShift(message.Fee.String(), 8)
 
 		symbol = strings.ReplaceAll(symbol, "TEST", "")
+		if message.Reverted {
+			// there is no revert call on the freezing system, leave it to the operators
+			log.Printf("%s %s tokens to %s reverted by chain reorg, tx: %s type: %d\n", symbol, amount, addr, message.TxHash, message.TxType)
+			if err := saveRevertedTx(message); err != nil {
+				log.Println("save reverted tx err:", err, message.TxHash)
+			}
+			if message.RequestId != "" {
+				updateWithdrawal(message)
+			}
+			continue
+		}
+		// every tx message is recorded by queueNotify, a missing or reverted
+		// delivery means its block was orphaned after it was queued
+		d, err := getDelivery(message)
+		if err != nil {
+			log.Println("drop tx without delivery:", err, message.TxHash, addr)
+			continue
+		} else if d.State != DELIVERY_PENDING {
+			continue
+		}
+		if message.RequestId != "" {
+			updateWithdrawal(message)
+		}
+		d.Attempts++
+
 		if symbol == "USDT" {
 			status, err := GetOmniTxStatus(config, message.TxHash)
 			if err != nil {
 				log.Println("get tx status err:", err, ", tx:", message.TxHash)
+				saveDelivery(d)
 				continue
 			}
 			if status == false {
 				log.Println("usdt tx status is fail, tx:", message.TxHash)
+				d.State = DELIVERY_FAILED
+				saveDelivery(d)
 				continue
 			}
 		}
 
+		// a fee bump is reported as the withdrawal of the tx it replaced
+		if message.OrigTxHash != "" {
+			log.Println("tx", message.TxHash, "replaces", message.OrigTxHash)
+			message.TxHash = message.OrigTxHash
+		}
+
 		switch message.TxType {
 		case TYPE_USER_DEPOSIT:
-			//small btc deposit less then 0.001 is ignored
-			if symbol == "BTC" && message.Amount.Uint64() < MIN_BTC_AMOUNT {
+			//small deposit is ignored
+			if message.Amount.Int64() < minDepositAmount(config, symbol) {
+				d.Tars = true
 				break
 			}
-			log.Printf("%s %s tokens deposit to %s, tx: %s\n", symbol, amount, addr, message.TxHash)
-			storeTokenDepositTx(config, symbol, message.TxHash, addr, amount)
+			if !d.Tars {
+				user := ""
+				if rec, err := lookupAddress(addr); err == nil {
+					user = rec.UserId
+				}
+				log.Printf("%s %s tokens deposit to %s, user: %s, tx: %s\n", symbol, amount, addr, user, message.TxHash)
+				d.Tars = storeTokenDepositTx(config, symbol, message.TxHash, addr, amount) == nil
+			}
 		case TYPE_USER_WITHDRAW:
-			log.Printf("%s %s tokens withdraw to %s, tx: %s fee: %s\n", symbol, amount, addr, message.TxHash, fee)
-			storeTokenWithdrawTx(config, symbol, message.TxHash, addr, amount, fee)
+			if !d.Tars {
+				log.Printf("%s %s tokens withdraw to %s, tx: %s output: %d fee: %s request: %s\n", symbol, amount, addr, message.TxHash, message.OutputIndex, fee, message.RequestId)
+				d.Tars = storeTokenWithdrawTx(config, symbol, message.TxHash, addr, amount, fee) == nil
+			}
+		default:
+			d.Tars = true
+		}
+		if !d.FundFlow {
+			d.FundFlow = EnterFundflowDB(config, message, symbol, fee) == nil
+		}
+
+		if d.Tars && d.FundFlow {
+			d.State = DELIVERY_DELIVERED
+		} else if d.Attempts >= MAX_DELIVERY_ATTEMPTS {
+			log.Println("give up notifying tx:", message.TxHash, addr)
+			d.State = DELIVERY_FAILED
+		}
+		if err = saveDelivery(d); err != nil {
+			log.Println("save delivery err:", err, message.TxHash)
 		}
-		EnterFundflowDB(config, message, symbol, fee)
 	}
 }
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	conf "github.com/bytefly/dashcash-wallet/config"
+	"github.com/bytefly/dashcash-wallet/util"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// a deposit is swept once it is worth this many times the fee of spending it
+const SWEEP_FEE_MULTIPLE = 3
+
+// sweepThreshold returns the smallest deposit utxo worth sweeping at feeRate.
+func sweepThreshold(config *conf.Config, feeRate uint32) int64 {
+	p := SelectionParams{FeePerKb: feeRate}
+	threshold := SWEEP_FEE_MULTIPLE * p.inputFee(&Utxo{})
+	if config.SweepMinAmount > threshold {
+		threshold = config.SweepMinAmount
+	}
+	return threshold
+}
+
+// sweepCandidates returns the confirmed deposit utxos above the threshold,
+// largest first.
+func sweepCandidates(threshold int64) ([]Utxo, error) {
+	utxos, err := GetAllUtxoByBranch(0, false)
+	if err != nil {
+		return nil, err
+	}
+
+	utxos, err = filterReserved(utxos)
+	if err != nil {
+		return nil, err
+	}
+	candidates := make([]Utxo, 0)
+	for _, u := range utxos {
+		if u.Height > 0 && u.Value >= threshold {
+			candidates = append(candidates, u)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Value > candidates[j].Value
+	})
+	return candidates, nil
+}
+
+// innerChangeScript returns the next inner change address and its script
+// without issuing it, useChangeAddress does once a tx paying it is broadcast.
+// The caller holds m.
+func innerChangeScript(config *conf.Config) (string, []byte, error) {
+	param := util.GetParamByName(config.ChainName)
+	changeAddress, err := peekAddress(config, util.BRANCH_INTERNAL)
+	if err != nil {
+		return "", nil, err
+	}
+	addr := changeAddress
+	if strings.HasPrefix(strings.ToLower(config.ChainName), "bch") {
+		addr, _ = util.ConvertCashAddrToLegacy(addr, param)
+	}
+	script, err := getScriptFromAddress(addr, param)
+	if err != nil {
+		return "", nil, err
+	}
+	return changeAddress, script, nil
+}
+
+// buildMergeTx spends the utxos to the change script in a single output.
+func buildMergeTx(utxos []Utxo, changeScript []byte, feeRate uint32) (*wire.MsgTx, error) {
+	tx := wire.NewMsgTx(wire.TxVersion)
+	scripts := make([][]byte, 0, len(utxos))
+	var balance int64
+	for _, u := range utxos {
+		hash, _ := chainhash.NewHashFromStr(u.Hash)
+		tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(hash, u.Index), nil, nil))
+		scripts = append(scripts, u.Script)
+		balance += u.Value
+	}
+
+	fee := txFee(feeRate, estimateVSize(tx, scripts, changeScript))
+	if balance-fee < minOutputAmount(feeRate) {
+		return nil, errors.New("utxos too small to pay the fee")
+	}
+	tx.AddTxOut(wire.NewTxOut(balance-fee, changeScript))
+	return tx, nil
+}
+
+// sweepDeposits collects the deposit utxos into an inner address, with one
+// tx per SweepMaxInputs utxos, and returns the broadcast txs. Once mined they
+// are notified as fund collections. The caller holds m.
+func sweepDeposits(config *conf.Config, feeRate uint32) ([]*SentTx, error) {
+	candidates, err := sweepCandidates(sweepThreshold(config, feeRate))
+	if err != nil {
+		return nil, err
+	}
+	changeAddress, changeScript, err := innerChangeScript(config)
+	if err != nil {
+		return nil, err
+	}
+
+	maxInputs := int(config.SweepMaxInputs)
+	if maxInputs <= 0 {
+		maxInputs = len(candidates)
+	}
+
+	sent := make([]*SentTx, 0)
+	for len(candidates) > 0 {
+		n := maxInputs
+		if n > len(candidates) {
+			n = len(candidates)
+		}
+		utxos := candidates[:n]
+		candidates = candidates[n:]
+
+		tx, err := buildMergeTx(utxos, changeScript, feeRate)
+		if err != nil {
+			log.Println("build sweep tx err:", err)
+			break
+		}
+		signedTx, err := signMsgTx(config.ChainName, config.Xpriv, tx, GetUtxoByKey, true)
+		if err != nil {
+			return sent, err
+		}
+		hash, err := broadcastTx(config, signedTx, feeRate)
+		if err != nil {
+			return sent, err
+		}
+		useChangeAddress(config, changeAddress)
+		s, err := getSentTx(hash)
+		if err != nil {
+			s = newSentTx(signedTx, utxos, feeRate)
+		}
+		s.Sweep = true
+		if err = saveSentTx(s); err != nil {
+			log.Println("save sent tx err:", err, hash)
+		}
+		log.Println("sweep", len(utxos), "deposit utxos by", hash, "fee:", s.Fee)
+		sent = append(sent, s)
+	}
+	return sent, nil
+}
+
+// isSweepTx tells whether the tx moves wallet funds into the inner addresses,
+// as a sweep does.
+func isSweepTx(hash string) bool {
+	s, err := getSentTx(hash)
+	return err == nil && s.Sweep
+}
+
+func runSweep(config *conf.Config) {
+	feeRate, err := EstimateFeeRate(config, config.SweepFeeTarget)
+	if err != nil {
+		log.Println("estimate sweep fee err:", err)
+		return
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	if _, err = sweepDeposits(config, feeRate); err != nil {
+		log.Println("sweep deposits err:", err)
+	}
+}
+
+// SweepScheduler sweeps the deposit addresses every interval until quit is
+// closed.
+func SweepScheduler(config *conf.Config, quit <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	interval := config.SweepInterval
+	if interval == 0 {
+		interval = 1
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+		runSweep(config)
+	}
+}
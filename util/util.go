@@ -13,43 +13,84 @@ import (
 	conf "github.com/bytefly/dashcash-wallet/config"
 	"golang.org/x/crypto/ripemd160"
 	"log"
+	"strconv"
 	"strings"
 	"sync"
 )
 
+const (
+	BRANCH_EXTERNAL uint32 = 0
+	BRANCH_INTERNAL uint32 = 1
+)
+
+// AddrPath is the derivation path of a wallet address below the account key.
+type AddrPath struct {
+	Branch uint32
+	Index  uint32
+}
+
+func (p AddrPath) String() string {
+	return fmt.Sprintf("%d/%d", p.Branch, p.Index)
+}
+
+// IsExternal tells whether the address is a user deposit address.
+func (p AddrPath) IsExternal() bool {
+	return p.Branch == BRANCH_EXTERNAL
+}
+
+// ParseAddrPath parses a "branch/index" path.
+func ParseAddrPath(str string) (AddrPath, error) {
+	var p AddrPath
+	pos := strings.IndexByte(str, '/')
+	if pos <= 0 {
+		return p, fmt.Errorf("invalid path %q", str)
+	}
+	branch, err := strconv.ParseUint(str[:pos], 10, 32)
+	if err != nil {
+		return p, fmt.Errorf("invalid path %q", str)
+	}
+	index, err := strconv.ParseUint(str[pos+1:], 10, 32)
+	if err != nil {
+		return p, fmt.Errorf("invalid path %q", str)
+	}
+	p.Branch, p.Index = uint32(branch), uint32(index)
+	return p, nil
+}
+
+// addrs caches the address registry kept in the db, address -> AddrPath
 var addrs sync.Map
 
-func AddressInit(xpub string, branch uint32, total int, param *chaincfg.Params) {
+// DeriveAddress returns the address at the path in the form the wallet
+// keeps it, the cash address without prefix on bch.
+func DeriveAddress(xpub string, path AddrPath, param *chaincfg.Params) (string, error) {
 	masterKey, err := hdkeychain.NewKeyFromString(xpub)
 	if err != nil {
-		log.Println(err)
-		return
+		return "", err
 	}
 
-	acct, err := masterKey.Child(branch)
+	acct, err := masterKey.Child(path.Branch)
 	if err != nil {
-		log.Println(err)
-		return
+		return "", err
 	}
 
-	for i := 0; i < total; i++ {
-		acctExt, err := acct.Child(uint32(i))
-		if err != nil {
-			log.Println(err)
-			return
-		}
+	acctExt, err := acct.Child(path.Index)
+	if err != nil {
+		return "", err
+	}
 
-		pubkey, _ := acctExt.ECPubKey()
-		addr := getAddrByPubKey(pubkey.SerializeCompressed(), param)
-		if strings.HasPrefix(strings.ToLower(param.Name), "bch") {
-			addr, _ = ConvertLegacyToCashAddr(addr, param)
-			addr = addr[len(param.Bech32HRPSegwit)+1:]
-		}
-		addrs.Store(addr, fmt.Sprintf("%d/%d", branch, i))
-		if branch == 1 && i == 0 {
-			log.Println("inner withdraw addr:", addr)
+	pubkey, err := acctExt.ECPubKey()
+	if err != nil {
+		return "", err
+	}
+	addr := getAddrByPubKey(pubkey.SerializeCompressed(), param)
+	if strings.HasPrefix(strings.ToLower(param.Name), "bch") {
+		addr, err = ConvertLegacyToCashAddr(addr, param)
+		if err != nil {
+			return "", err
 		}
+		addr = addr[len(param.Bech32HRPSegwit)+1:]
 	}
+	return addr, nil
 }
 
 func getAddrByPubKey(pubKeyBytes []byte, param *chaincfg.Params) string {
@@ -114,10 +155,11 @@ func getNewAddrByBranch(config *conf.Config, branch, index uint32) (addr string,
 	pubkey, _ := acctExt.ECPubKey()
 	param := GetParamByName(config.ChainName)
 	addr = getAddrByPubKey(pubkey.SerializeCompressed(), param)
-	addrs.Store(addr, fmt.Sprintf("%d/%d", branch, index))
 	return
 }
 
+// GetPrivateKey returns the key of the address at branch/index, derived
+// from xpriv the way DeriveAddress derives the address from the xpub.
 func GetPrivateKey(xpriv string, branch int, index int) (privKey *btcec.PrivateKey, err error) {
 	masterKey, err := hdkeychain.NewKeyFromString(xpriv)
 	if err != nil {
@@ -125,7 +167,13 @@ func GetPrivateKey(xpriv string, branch int, index int) (privKey *btcec.PrivateK
 		return
 	}
 
-	acctExt, err := masterKey.Child(uint32(index))
+	acct, err := masterKey.Child(uint32(branch))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	acctExt, err := acct.Child(uint32(index))
 	if err != nil {
 		log.Println(err)
 		return
@@ -266,14 +314,21 @@ func IsNativeSegWitAddress(chain, address string) bool {
 	}
 }
 
-func LoadAddrPath(addr string) (string, bool) {
+func LoadAddrPath(addr string) (AddrPath, bool) {
 	path, ok := addrs.Load(addr)
 	if !ok {
-		return "", ok
+		return AddrPath{}, ok
 	}
-	return path.(string), ok
+	return path.(AddrPath), ok
 }
 
-func StoreAddrPath(addr, path string) {
+func StoreAddrPath(addr string, path AddrPath) {
 	addrs.Store(addr, path)
 }
+
+// RangeAddrPath calls fn for every known address until it returns false.
+func RangeAddrPath(fn func(addr string, path AddrPath) bool) {
+	addrs.Range(func(k, v interface{}) bool {
+		return fn(k.(string), v.(AddrPath))
+	})
+}
@@ -2,6 +2,9 @@ package util
 
 import (
 	"fmt"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcutil/hdkeychain"
+	"strings"
 	"testing"
 )
 
@@ -54,3 +57,111 @@ func TestDecode(t *testing.T) {
 		}
 	}
 }
+
+func TestParseAddrPath(t *testing.T) {
+	cases := []struct {
+		str  string
+		path AddrPath
+		ok   bool
+	}{
+		{"0/0", AddrPath{BRANCH_EXTERNAL, 0}, true},
+		{"1/25", AddrPath{BRANCH_INTERNAL, 25}, true},
+		{"0/4294967295", AddrPath{0, 4294967295}, true},
+		{"", AddrPath{}, false},
+		{"0", AddrPath{}, false},
+		{"/1", AddrPath{}, false},
+		{"0/", AddrPath{}, false},
+		{"a/1", AddrPath{}, false},
+		{"0/-1", AddrPath{}, false},
+		{"0/4294967296", AddrPath{}, false},
+		{"0/1/2", AddrPath{}, false},
+	}
+
+	for _, c := range cases {
+		path, err := ParseAddrPath(c.str)
+		if (err == nil) != c.ok {
+			t.Fatalf("%q: err %v", c.str, err)
+		}
+		if !c.ok {
+			continue
+		}
+		if path != c.path || path.String() != c.str {
+			t.Fatalf("%q: parsed %v", c.str, path)
+		}
+	}
+}
+
+func TestDeriveAddress(t *testing.T) {
+	// master key of the first bip32 test vector
+	xpub := "xpub661MyMwAqRbcFtXgS5sYJABqqG9YLmC4Q1Rdap9gSE8NqtwybGhePY2gZ29ESFjqJoCu1Rupje8YtGqsefD265TMg7usUDFdp6W1EGMcet8"
+	master, err := hdkeychain.NewKeyFromString(xpub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[string]AddrPath)
+	for _, path := range []AddrPath{{0, 0}, {0, 1}, {1, 0}, {1, 1}, {0, 1000}} {
+		addr, err := DeriveAddress(xpub, path, &chaincfg.MainNetParams)
+		if err != nil {
+			t.Fatal(path, err)
+		}
+		branch, _ := master.Child(path.Branch)
+		key, _ := branch.Child(path.Index)
+		want, err := key.Address(&chaincfg.MainNetParams)
+		if err != nil {
+			t.Fatal(path, err)
+		}
+		if addr != want.EncodeAddress() {
+			t.Fatalf("%v: derived %s, want %s", path, addr, want.EncodeAddress())
+		}
+		if other, ok := seen[addr]; ok {
+			t.Fatalf("%v and %v derive %s", path, other, addr)
+		}
+		seen[addr] = path
+
+		// bch keeps the cash address without prefix
+		cashAddr, err := DeriveAddress(xpub, path, &BCHMainNetParams)
+		if err != nil {
+			t.Fatal(path, err)
+		}
+		if strings.Contains(cashAddr, ":") {
+			t.Fatalf("%v: cash address %s has a prefix", path, cashAddr)
+		}
+		if legacy, err := ConvertCashAddrToLegacy(cashAddr, &BCHMainNetParams); err != nil || legacy != addr {
+			t.Fatalf("%v: cash address %s is %s, want %s", path, cashAddr, legacy, addr)
+		}
+	}
+
+	if _, err = DeriveAddress("xpub", AddrPath{}, &chaincfg.MainNetParams); err == nil {
+		t.Fatal("invalid xpub derived")
+	}
+	// private derivation is not possible from the xpub
+	if _, err = DeriveAddress(xpub, AddrPath{hdkeychain.HardenedKeyStart, 0}, &chaincfg.MainNetParams); err == nil {
+		t.Fatal("hardened path derived")
+	}
+}
+
+func TestGetPrivateKey(t *testing.T) {
+	master, err := hdkeychain.NewMaster(make([]byte, 32), &chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xpub, err := master.Neuter()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []AddrPath{{BRANCH_EXTERNAL, 0}, {BRANCH_EXTERNAL, 7}, {BRANCH_INTERNAL, 0}, {BRANCH_INTERNAL, 7}} {
+		addr, err := DeriveAddress(xpub.String(), path, &chaincfg.MainNetParams)
+		if err != nil {
+			t.Fatal(path, err)
+		}
+		privKey, err := GetPrivateKey(master.String(), int(path.Branch), int(path.Index))
+		if err != nil {
+			t.Fatal(path, err)
+		}
+		if keyAddr := getAddrByPubKey(privKey.PubKey().SerializeCompressed(), &chaincfg.MainNetParams); keyAddr != addr {
+			t.Fatalf("%v: key of %s, want %s", path, keyAddr, addr)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+const (
+	WITNESS_SCALE_FACTOR = 4
+
+	// outpoint, script length, sequence and a 107 bytes signature and compressed pubkey
+	P2PKH_INPUT_WEIGHT = (32 + 4 + 1 + 107 + 4) * WITNESS_SCALE_FACTOR
+	// outpoint, script length, sequence and a 73 bytes signature
+	P2PK_INPUT_WEIGHT = (32 + 4 + 1 + 73 + 4) * WITNESS_SCALE_FACTOR
+	// witness: item count, signature and compressed pubkey
+	P2WPKH_WITNESS_WEIGHT = 1 + 1 + 72 + 1 + 33
+	// empty script sig, the witness program is in the witness
+	P2WPKH_INPUT_WEIGHT = (32+4+1+4)*WITNESS_SCALE_FACTOR + P2WPKH_WITNESS_WEIGHT
+	// script sig pushes the 22 bytes witness program
+	P2SH_P2WPKH_INPUT_WEIGHT = (32+4+1+23+4)*WITNESS_SCALE_FACTOR + P2WPKH_WITNESS_WEIGHT
+)
+
+// inputWeight returns the weight of a signed input spending the script and
+// whether it carries witness data. Unknown scripts are sized as P2PKH.
+func inputWeight(script []byte) (int64, bool) {
+	switch txscript.GetScriptClass(script) {
+	case txscript.PubKeyTy:
+		return P2PK_INPUT_WEIGHT, false
+	case txscript.WitnessV0PubKeyHashTy:
+		return P2WPKH_INPUT_WEIGHT, true
+	case txscript.ScriptHashTy:
+		// the wallet only spends P2SH wrapped P2WPKH
+		return P2SH_P2WPKH_INPUT_WEIGHT, true
+	}
+	return P2PKH_INPUT_WEIGHT, false
+}
+
+func outputWeight(script []byte) int64 {
+	return int64(8+wire.VarIntSerializeSize(uint64(len(script)))+len(script)) * WITNESS_SCALE_FACTOR
+}
+
+// estimateVSize returns the virtual size of the tx once all of its inputs are
+// signed. scripts[i] is the script spent by input i, extra holds the scripts
+// of outputs not added to the tx yet.
+func estimateVSize(tx *wire.MsgTx, scripts [][]byte, extra ...[]byte) int64 {
+	var witness bool
+	var legacy int64
+
+	// version and lock time
+	weight := int64(4+4) * WITNESS_SCALE_FACTOR
+	weight += int64(wire.VarIntSerializeSize(uint64(len(tx.TxIn)))) * WITNESS_SCALE_FACTOR
+	weight += int64(wire.VarIntSerializeSize(uint64(len(tx.TxOut)+len(extra)))) * WITNESS_SCALE_FACTOR
+
+	for i := range tx.TxIn {
+		var script []byte
+		if i < len(scripts) {
+			script = scripts[i]
+		}
+		w, isWitness := inputWeight(script)
+		weight += w
+		witness = witness || isWitness
+		if !isWitness {
+			legacy++
+		}
+	}
+	for _, out := range tx.TxOut {
+		weight += outputWeight(out.PkScript)
+	}
+	for _, script := range extra {
+		weight += outputWeight(script)
+	}
+
+	if witness {
+		// segwit marker and flag, and the empty witness of each legacy input
+		weight += 2 + legacy
+	}
+	return (weight + WITNESS_SCALE_FACTOR - 1) / WITNESS_SCALE_FACTOR
+}
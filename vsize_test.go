@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"github.com/btcsuite/btcd/wire"
+	"testing"
+)
+
+func testScript(prefix []byte, size int, suffix ...byte) []byte {
+	script := append([]byte(nil), prefix...)
+	script = append(script, bytes.Repeat([]byte{0x01}, size)...)
+	return append(script, suffix...)
+}
+
+func TestEstimateVSize(t *testing.T) {
+	p2pkh := testScript([]byte{0x76, 0xa9, 0x14}, 20, 0x88, 0xac)
+	p2wpkh := testScript([]byte{0x00, 0x14}, 20)
+	p2sh := testScript([]byte{0xa9, 0x14}, 20, 0x87)
+	p2pk := testScript([]byte{0x21, 0x02}, 32, 0xac)
+
+	cases := []struct {
+		name    string
+		ins     int
+		scripts [][]byte
+		outputs [][]byte
+		extra   [][]byte
+		vsize   int64
+	}{
+		{"p2pkh 1-in 2-out", 1, [][]byte{p2pkh}, [][]byte{p2pkh, p2pkh}, nil, 226},
+		{"p2wpkh 1-in 2-out", 1, [][]byte{p2wpkh}, [][]byte{p2wpkh, p2wpkh}, nil, 141},
+		{"p2sh-p2wpkh with extra output", 1, [][]byte{p2sh}, [][]byte{p2wpkh}, [][]byte{p2sh}, 165},
+		{"mixed inputs", 2, [][]byte{p2pkh, p2wpkh}, [][]byte{p2pkh}, nil, 261},
+		// each legacy input has an empty witness once the tx has witness data
+		{"mixed inputs with empty witnesses", 4, [][]byte{p2pkh, p2pkh, p2pkh, p2wpkh}, [][]byte{p2pkh}, nil, 558},
+		{"p2pk input", 1, [][]byte{p2pk}, [][]byte{p2pkh}, nil, 158},
+		{"unknown scripts as p2pkh", 2, nil, [][]byte{p2pkh}, nil, 340},
+	}
+
+	for _, c := range cases {
+		tx := wire.NewMsgTx(wire.TxVersion)
+		for i := 0; i < c.ins; i++ {
+			tx.AddTxIn(wire.NewTxIn(&wire.OutPoint{}, nil, nil))
+		}
+		for _, script := range c.outputs {
+			tx.AddTxOut(wire.NewTxOut(1000, script))
+		}
+		if vsize := estimateVSize(tx, c.scripts, c.extra...); vsize != c.vsize {
+			t.Fatalf("%s: vsize %d, want %d", c.name, vsize, c.vsize)
+		}
+	}
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	conf "github.com/bytefly/dashcash-wallet/config"
+	"log"
+	"strconv"
+	"time"
+
+	badger "github.com/dgraph-io/badger"
+)
+
+const (
+	WITHDRAWAL_QUEUED = iota
+	WITHDRAWAL_BROADCAST
+	WITHDRAWAL_CONFIRMED
+	WITHDRAWAL_FAILED
+	// paid by a batch tx recorded before its broadcast, until the node is
+	// known to have it or not
+	WITHDRAWAL_SENDING
+
+	// fail a queued withdrawal after so many unsuccessful batches
+	MAX_WITHDRAWAL_ATTEMPTS = 5
+
+	WITHDRAWAL_KEY_PREFIX = "withdrawal/"
+	WQUEUE_KEY_PREFIX     = "wqueue/"
+	WITHDRAWAL_SEQ_KEY    = "meta/withdrawalSeq"
+	// wrequest/<requestId> -> withdrawal id, one withdrawal per request
+	WREQUEST_KEY_PREFIX = "wrequest/"
+)
+
+var errRequestIdTaken = errors.New("request id used by another withdrawal")
+
+var withdrawalStateNames = []string{"queued", "broadcast", "confirmed", "failed", "sending"}
+
+// Withdrawal is a request waiting in the queue or paid by a batch tx.
+type Withdrawal struct {
+	Id        uint64
+	RequestId string
+	To        string
+	Amount    int64
+	State     int
+	TxHash    string
+	Fee       int64
+	Attempts  int
+	Error     string
+	Created   int64
+	Updated   int64
+}
+
+// wakes the scheduler up when enough requests are waiting
+var withdrawalWake = make(chan struct{}, 1)
+
+func withdrawalKey(id uint64) []byte {
+	return heightKey(WITHDRAWAL_KEY_PREFIX, id)
+}
+
+// putWithdrawal stores the withdrawal and keeps it in the queue index while
+// it is queued.
+func putWithdrawal(txn *badger.Txn, w *Withdrawal) error {
+	w.Updated = time.Now().Unix()
+	buf, err := json.Marshal(w)
+	if err != nil {
+		return err
+	}
+	if err = txn.Set(withdrawalKey(w.Id), buf); err != nil {
+		return err
+	}
+
+	if w.State == WITHDRAWAL_QUEUED {
+		return txn.Set(heightKey(WQUEUE_KEY_PREFIX, w.Id), nil)
+	}
+	return txn.Delete(heightKey(WQUEUE_KEY_PREFIX, w.Id))
+}
+
+func saveWithdrawal(w *Withdrawal) error {
+	return db.Update(func(txn *badger.Txn) error {
+		return putWithdrawal(txn, w)
+	})
+}
+
+func readWithdrawal(txn *badger.Txn, id uint64) (*Withdrawal, error) {
+	item, err := txn.Get(withdrawalKey(id))
+	if err != nil {
+		return nil, err
+	}
+	w := new(Withdrawal)
+	err = item.Value(func(v []byte) error {
+		return json.Unmarshal(v, w)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func getWithdrawal(id uint64) (*Withdrawal, error) {
+	var w *Withdrawal
+	err := db.View(func(txn *badger.Txn) error {
+		var err error
+		w, err = readWithdrawal(txn, id)
+		return err
+	})
+	return w, err
+}
+
+func requestKey(requestId string) []byte {
+	return []byte(WREQUEST_KEY_PREFIX + requestId)
+}
+
+// enqueueWithdrawal queues a payment and returns it with its new id. The
+// request id defaults to the withdrawal id. A retried request gets its
+// withdrawal back with queued false, whatever its state, and a request id
+// taken by another payment is an error.
+func enqueueWithdrawal(to string, amount int64, requestId string) (w *Withdrawal, queued bool, err error) {
+	err = db.Update(func(txn *badger.Txn) error {
+		if requestId != "" {
+			old, err := requestWithdrawal(txn, requestId)
+			if err == nil {
+				if old.To != to || old.Amount != amount {
+					return errRequestIdTaken
+				}
+				w = old
+				return nil
+			} else if err != badger.ErrKeyNotFound {
+				return err
+			}
+		}
+
+		w = &Withdrawal{To: to, Amount: amount, RequestId: requestId, State: WITHDRAWAL_QUEUED, Created: time.Now().Unix()}
+		id, err := nextSequence(txn, WITHDRAWAL_SEQ_KEY)
+		if err != nil {
+			return err
+		}
+		w.Id = id
+		if w.RequestId == "" {
+			w.RequestId = strconv.FormatUint(w.Id, 10)
+			if _, err = txn.Get(requestKey(w.RequestId)); err == nil {
+				return errRequestIdTaken
+			} else if err != badger.ErrKeyNotFound {
+				return err
+			}
+		}
+		seq := make([]byte, 8)
+		binary.BigEndian.PutUint64(seq, w.Id)
+		if err = txn.Set(requestKey(w.RequestId), seq); err != nil {
+			return err
+		}
+		queued = true
+		return putWithdrawal(txn, w)
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return w, queued, nil
+}
+
+// requestWithdrawal reads the withdrawal queued for the request.
+func requestWithdrawal(txn *badger.Txn, requestId string) (*Withdrawal, error) {
+	item, err := txn.Get(requestKey(requestId))
+	if err != nil {
+		return nil, err
+	}
+	var id uint64
+	err = item.Value(func(v []byte) error {
+		id = binary.BigEndian.Uint64(v)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return readWithdrawal(txn, id)
+}
+
+// queuedWithdrawals returns the queued withdrawals, oldest first.
+func queuedWithdrawals() ([]*Withdrawal, error) {
+	ids := make([]uint64, 0)
+	err := db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		prefix := []byte(WQUEUE_KEY_PREFIX)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			ids = append(ids, binary.BigEndian.Uint64(it.Item().Key()[len(prefix):]))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	withdrawals := make([]*Withdrawal, 0, len(ids))
+	for _, id := range ids {
+		w, err := getWithdrawal(id)
+		if err != nil {
+			return nil, err
+		}
+		withdrawals = append(withdrawals, w)
+	}
+	return withdrawals, nil
+}
+
+// pickWithdrawals takes the queued withdrawals for the next batch. Requests
+// to the same address go to different txs since outputs are attributed by
+// address.
+func pickWithdrawals(config *conf.Config, queued []*Withdrawal) []*Withdrawal {
+	picked := make([]*Withdrawal, 0)
+	seen := make(map[string]bool)
+	for _, w := range queued {
+		if seen[w.To] {
+			continue
+		}
+		seen[w.To] = true
+		picked = append(picked, w)
+		if config.WithdrawMaxOutputs > 0 && len(picked) >= int(config.WithdrawMaxOutputs) {
+			break
+		}
+	}
+	return picked
+}
+
+// payWithdrawals pays the withdrawals with one batch tx. On success they are
+// left broadcast, on errSendUnresolved sending, and queued otherwise.
+func payWithdrawals(config *conf.Config, picked []*Withdrawal) error {
+	batch := make([]BatchOutput, 0, len(picked))
+	for _, w := range picked {
+		batch = append(batch, BatchOutput{RequestId: w.RequestId, Address: w.To, Amount: w.Amount, Index: uint32(len(batch)), Withdrawal: w.Id})
+	}
+	_, err := sendWithdrawalBatch(config, batch)
+	return err
+}
+
+// failWithdrawalAttempt counts a failed payment of the queued withdrawal,
+// and gives it up after MAX_WITHDRAWAL_ATTEMPTS.
+func failWithdrawalAttempt(id uint64, cause error) {
+	err := db.Update(func(txn *badger.Txn) error {
+		w, err := readWithdrawal(txn, id)
+		if err != nil {
+			return err
+		}
+		if w.State != WITHDRAWAL_QUEUED {
+			return nil
+		}
+		w.Attempts++
+		w.Error = cause.Error()
+		if w.Attempts >= MAX_WITHDRAWAL_ATTEMPTS {
+			log.Println("give up withdrawal:", w.Id, w.RequestId)
+			w.State = WITHDRAWAL_FAILED
+		}
+		return putWithdrawal(txn, w)
+	})
+	if err != nil {
+		log.Println("save withdrawal err:", err, id)
+	}
+}
+
+// processWithdrawals pays the queued withdrawals with batch txs, once the
+// batch txs left sending by an earlier run are settled. When a batch fails
+// its requests are sent one by one, so a bad request only fails itself.
+func processWithdrawals(config *conf.Config) {
+	m.Lock()
+	resolveSendingTxs(config)
+	m.Unlock()
+
+	for {
+		queued, err := queuedWithdrawals()
+		if err != nil {
+			log.Println("list withdrawal queue err:", err)
+			return
+		}
+		if len(queued) == 0 {
+			return
+		}
+
+		picked := pickWithdrawals(config, queued)
+		err = payWithdrawals(config, picked)
+		if err == errSendUnresolved {
+			return
+		}
+		if err != nil {
+			log.Println("send withdrawal batch err:", err)
+			if len(picked) > 1 {
+				log.Println("send the", len(picked), "requests of the batch one by one")
+				for _, w := range picked {
+					err = payWithdrawals(config, []*Withdrawal{w})
+					if err == errSendUnresolved {
+						return
+					}
+					if err != nil {
+						log.Println("send withdrawal err:", err, w.Id)
+						failWithdrawalAttempt(w.Id, err)
+					}
+				}
+			} else {
+				failWithdrawalAttempt(picked[0].Id, err)
+			}
+			return
+		}
+		if len(picked) == len(queued) {
+			return
+		}
+	}
+}
+
+func sendWithdrawalBatch(config *conf.Config, batch []BatchOutput) (string, error) {
+	feeRate, err := EstimateFeeRate(config, config.WithdrawFeeTarget)
+	if err != nil {
+		return "", err
+	}
+	selector, err := coinSelectorFor(config, "withdrawal")
+	if err != nil {
+		return "", err
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	hash, _, err := sendBatch(config, batch, feeRate, selector)
+	return hash, err
+}
+
+// updateWithdrawal marks the queued withdrawal paid by the batch output of
+// the message confirmed, or back to broadcast when the block was reverted.
+func updateWithdrawal(message NotifyMessage) {
+	batch, err := getBatch(message.TxHash)
+	if err != nil {
+		return
+	}
+	for _, o := range batch {
+		if o.RequestId != message.RequestId || o.Withdrawal == 0 {
+			continue
+		}
+		w, err := getWithdrawal(o.Withdrawal)
+		if err != nil {
+			log.Println("get withdrawal err:", err, o.Withdrawal)
+			return
+		}
+		if message.Reverted {
+			w.State = WITHDRAWAL_BROADCAST
+		} else {
+			w.State = WITHDRAWAL_CONFIRMED
+		}
+		if err = saveWithdrawal(w); err != nil {
+			log.Println("save withdrawal err:", err, w.Id)
+		}
+		return
+	}
+}
+
+// WithdrawalScheduler drains the withdrawal queue every interval or when
+// woken up, until quit is closed.
+func WithdrawalScheduler(config *conf.Config, quit <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	interval := config.WithdrawInterval
+	if interval == 0 {
+		interval = 1
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		case <-withdrawalWake:
+		}
+		processWithdrawals(config)
+	}
+}
+
+// wakeWithdrawalScheduler makes the scheduler run now if enough requests
+// are waiting.
+func wakeWithdrawalScheduler(config *conf.Config) {
+	if config.WithdrawBatchSize == 0 {
+		return
+	}
+	n := 0
+	db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		prefix := []byte(WQUEUE_KEY_PREFIX)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			n++
+		}
+		return nil
+	})
+	if n < int(config.WithdrawBatchSize) {
+		return
+	}
+	select {
+	case withdrawalWake <- struct{}{}:
+	default:
+	}
+}
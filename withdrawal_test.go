@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestEnqueueWithdrawalRequestId(t *testing.T) {
+	if err := openDb(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer closeDb()
+
+	first, queued, err := enqueueWithdrawal("a", 1000, "r1")
+	if err != nil || !queued {
+		t.Fatal("queue r1:", queued, err)
+	}
+
+	cases := []struct {
+		name      string
+		to        string
+		amount    int64
+		requestId string
+		queued    bool
+		err       error
+	}{
+		{"retry", "a", 1000, "r1", false, nil},
+		{"other amount", "a", 2000, "r1", false, errRequestIdTaken},
+		{"other address", "b", 1000, "r1", false, errRequestIdTaken},
+		{"new request", "a", 1000, "r2", true, nil},
+		{"default request id", "a", 1000, "", true, nil},
+		// the default request id of the previous withdrawal
+		{"taken default", "c", 1, "3", false, errRequestIdTaken},
+	}
+	for _, c := range cases {
+		w, queued, err := enqueueWithdrawal(c.to, c.amount, c.requestId)
+		if err != c.err || queued != c.queued {
+			t.Fatalf("%s: queued %v err %v", c.name, queued, err)
+		}
+		if c.name == "retry" && w.Id != first.Id {
+			t.Fatalf("%s: withdrawal %d, want %d", c.name, w.Id, first.Id)
+		}
+	}
+
+	queue, err := queuedWithdrawals()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queue) != 3 {
+		t.Fatalf("%d withdrawals queued, want 3", len(queue))
+	}
+}
@@ -6,14 +6,23 @@ import (
 	zmq "github.com/pebbe/zmq4"
 
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"log"
 	"time"
 )
 
+const (
+	ZMQ_MIN_BACKOFF = time.Second
+	ZMQ_MAX_BACKOFF = 60 * time.Second
+)
+
 var (
 	subSocket *zmq.Socket
 	poller    *zmq.Poller
+
+	// last sequence number seen for each topic
+	zmqSeq = make(map[string]uint32)
 )
 
 func zmqInit(url string) (err error) {
@@ -22,6 +31,7 @@ func zmqInit(url string) (err error) {
 		log.Println("new zmq subscript err:", err)
 		return
 	}
+	subSocket.SetSubscribe("hashblock")
 	subSocket.SetSubscribe("rawtx")
 
 	err = subSocket.Connect(url)
@@ -32,10 +42,23 @@ func zmqInit(url string) (err error) {
 
 	poller = zmq.NewPoller()
 	poller.Add(subSocket, zmq.POLLIN)
+	// sequence numbers restart with a new connection
+	zmqSeq = make(map[string]uint32)
 	log.Println("zmq init ok")
 	return
 }
 
+// zmqCheckSeq returns false when messages of the topic were dropped.
+func zmqCheckSeq(topic string, seq uint32) bool {
+	last, ok := zmqSeq[topic]
+	zmqSeq[topic] = seq
+	if ok && seq != last+1 {
+		log.Println("zmq", topic, "messages dropped, last:", last, "now:", seq)
+		return false
+	}
+	return true
+}
+
 func zmqProcess(config *conf.Config, chainName string, ch chan<- ObjMessage) error {
 	if poller == nil || subSocket == nil {
 		return errors.New("zmq not init yet")
@@ -48,50 +71,40 @@ func zmqProcess(config *conf.Config, chainName string, ch chan<- ObjMessage) err
 	}
 
 	for _, s := range sockets {
-		if s.Socket == subSocket {
-			cmd, err := subSocket.RecvBytes(0)
-			if err != nil {
-				log.Println("zmq recv err:", err)
-				break
-			}
+		if s.Socket != subSocket {
+			continue
+		}
 
-			for {
-				more, err := subSocket.GetRcvmore()
-				if err != nil {
-					log.Println("zmq rcvmore err:", err)
-					break
-				}
-				if !more {
-					break
-				}
-
-				msg, err := subSocket.RecvBytes(0)
-				if err != nil {
-					log.Println("zmq recv err:", err)
-					break
-				}
-				if len(msg) != 4 {
-					if err == nil {
-						switch string(cmd) {
-						case "rawtx":
-							var tx wire.MsgTx
-							rbuf := bytes.NewReader(msg)
-							err = tx.Deserialize(rbuf)
-							if err == nil {
-								ParseMempoolTransaction(config, &tx, chainName)
-							}
-						case "hashblock":
-							GetNewerBlock(config, ch)
-						}
-					}
-				} else { //4 bytes nSequence
-					//log.Println(binary.LittleEndian.Uint32(msg))
-					break
-				}
-			}
-			if err != nil {
-				return err
+		// topic, body and 4 bytes nSequence
+		msg, err := subSocket.RecvMessageBytes(0)
+		if err != nil {
+			log.Println("zmq recv err:", err)
+			return err
+		}
+		if len(msg) != 3 || len(msg[2]) != 4 {
+			log.Println("invalid zmq message, parts:", len(msg))
+			continue
+		}
+
+		cmd := string(msg[0])
+		if !zmqCheckSeq(cmd, binary.LittleEndian.Uint32(msg[2])) && cmd != "hashblock" {
+			// catch up with the blocks, missed mempool txs come with them
+			GetNewerBlock(config, ch)
+		}
+
+		switch cmd {
+		case "rawtx":
+			var tx wire.MsgTx
+			rbuf := bytes.NewReader(msg[1])
+			err = tx.Deserialize(rbuf)
+			if err == nil {
+				// the handlers and schedulers update the same utxos under m
+				m.Lock()
+				ParseMempoolTransaction(config, &tx, chainName)
+				m.Unlock()
 			}
+		case "hashblock":
+			GetNewerBlock(config, ch)
 		}
 	}
 
@@ -99,6 +112,10 @@ func zmqProcess(config *conf.Config, chainName string, ch chan<- ObjMessage) err
 }
 
 func zmqClose(url string) {
+	if subSocket == nil {
+		return
+	}
+
 	err := subSocket.Disconnect(url)
 	if err != nil {
 		log.Println("zmq disconnect err:", err)
@@ -106,9 +123,54 @@ func zmqClose(url string) {
 
 	subSocket.SetLinger(0)
 	subSocket.Close()
+	subSocket = nil
+	poller = nil
 }
 
-func zmqRestart(url string) {
+func zmqRestart(url string) error {
 	zmqClose(url)
-	zmqInit(url)
+	return zmqInit(url)
+}
+
+// ZmqSubscriber receives block and mempool notifications from the node until
+// quit is closed, reconnecting with backoff when the socket fails.
+func ZmqSubscriber(config *conf.Config, ch chan<- ObjMessage, quit <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	backoff := ZMQ_MIN_BACKOFF
+	err := zmqInit(config.ZmqURL)
+	for {
+		if err != nil {
+			log.Println("zmq reconnect in", backoff)
+			select {
+			case <-quit:
+				zmqClose(config.ZmqURL)
+				return
+			case <-time.After(backoff):
+			}
+
+			backoff *= 2
+			if backoff > ZMQ_MAX_BACKOFF {
+				backoff = ZMQ_MAX_BACKOFF
+			}
+			if err = zmqRestart(config.ZmqURL); err != nil {
+				continue
+			}
+			// something may be missed while disconnected
+			GetNewerBlock(config, ch)
+		}
+
+		select {
+		case <-quit:
+			zmqClose(config.ZmqURL)
+			log.Println("zmq subscriber stopped")
+			return
+		default:
+		}
+
+		err = zmqProcess(config, config.ChainName, ch)
+		if err == nil {
+			backoff = ZMQ_MIN_BACKOFF
+		}
+	}
 }